@@ -0,0 +1,248 @@
+package main
+
+import (
+	"dotbuilder/internal/taskrunner"
+	"dotbuilder/pkg/logger"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func runApply(args []string) int {
+	fs, f := newFlagSet("apply")
+	fs.BoolVar(&f.dryRun, "n", false, "Dry-run mode")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Dry-run mode")
+	fs.BoolVar(&f.prune, "prune", false, "Remove files that were removed from the config")
+	fs.BoolVar(&f.upgrade, "upgrade", false, "Upgrade packages that are already installed")
+	fs.BoolVar(&f.locked, "locked", false, "Install the versions recorded in dotbuilder.lock")
+	sel := addSelectFlags(fs)
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+	if f.locked && f.upgrade {
+		logger.Fail("-locked and -upgrade cannot be used together")
+		return exitUsage
+	}
+	return apply(f, sel)
+}
+
+func runUpgrade(args []string) int {
+	fs, f := newFlagSet("upgrade")
+	fs.BoolVar(&f.dryRun, "n", false, "Dry-run mode")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Dry-run mode")
+	sel := addSelectFlags(fs)
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	s := newSession(f, f.dryRun)
+	if !s.selectNodes(sel) {
+		return exitUsage
+	}
+
+	// Only packages take part; dependencies on files and tasks count as met.
+	var pkgs []taskrunner.Node
+	for _, n := range s.nodes {
+		if _, ok := n.(*taskrunner.PkgNode); ok {
+			pkgs = append(pkgs, n)
+		} else {
+			if s.ctx.Detached == nil {
+				s.ctx.Detached = make(map[string]bool)
+			}
+			s.ctx.Detached[n.ID()] = true
+		}
+	}
+	s.nodes = pkgs
+	s.engine.Upgrade = true
+	s.engine.NoInstall = true
+
+	return run(f, s)
+}
+
+func runPlan(args []string) int {
+	fs, f := newFlagSet("plan")
+	fs.BoolVar(&f.locked, "locked", false, "Plan with the versions recorded in dotbuilder.lock")
+	sel := addSelectFlags(fs)
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+	f.dryRun = true
+	return apply(f, sel)
+}
+
+func apply(f *flags, sel *taskrunner.Selector) int {
+	s := newSession(f, f.dryRun)
+	if !s.selectNodes(sel) {
+		return exitUsage
+	}
+	s.engine.Upgrade = f.upgrade
+	if f.locked && !s.useLock() {
+		return exitFailed
+	}
+
+	return run(f, s)
+}
+
+// run executes the session's nodes, records the state and prints the summary.
+func run(f *flags, s *session) int {
+	// Setup sudo refresh for non-root users
+	if !s.isRoot && !f.dryRun {
+		setupSudoRefresh()
+	}
+
+	results := taskrunner.RunPhased(s.nodes, s.ctx)
+	if !f.dryRun {
+		saveState(f, s, results)
+	}
+	failed := taskrunner.PrintSummary(results, s.nodes) > 0
+	if f.prune && prune(f, s) != exitOK {
+		failed = true
+	}
+	if failed {
+		return exitFailed
+	}
+	logger.Success("All build tasks completed")
+	return exitOK
+}
+
+func runStatus(args []string) int {
+	fs, f := newFlagSet("status")
+	sel := addSelectFlags(fs)
+	managed := fs.Bool("managed", false, "List what previous runs recorded instead of checking the machine")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	if *managed {
+		st := loadState(f)
+		if len(st.Entries) == 0 {
+			logger.Info("No runs recorded in %s", f.stateFile)
+			return exitOK
+		}
+		logger.Info("Last run: %s (config: %s)", st.LastRun, st.Config)
+		taskrunner.PrintManaged(st)
+		return exitOK
+	}
+
+	// Checks must really run, so the session is not a dry-run; nothing is executed.
+	f.tmpScripts = true
+	s := newSession(f, false)
+	defer s.close()
+	if !s.selectNodes(sel) {
+		return exitUsage
+	}
+	states, details := taskrunner.Inspect(s.nodes, s.ctx)
+	if drift := taskrunner.PrintStatus(states, details, s.nodes); drift > 0 {
+		logger.Warn("%d of %d nodes differ from the config.", drift, len(s.nodes))
+		return exitDrift
+	}
+	logger.Success("Machine matches the config")
+	return exitOK
+}
+
+func runValidate(args []string) int {
+	fs, f := newFlagSet("validate")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	// Report every problem instead of stopping at the first invalid config.
+	f.lenient = true
+	f.readOnly = true
+	s := newSession(f, true)
+
+	for _, w := range s.cfg.Warnings {
+		logger.Warn("%s", w)
+	}
+	var problems []string
+	for _, d := range s.cfg.Validate() {
+		problems = append(problems, d.String())
+	}
+	// Graph checks repeat dangling deps and duplicates, so only run them on a sound config.
+	if len(problems) == 0 {
+		for _, err := range taskrunner.Validate(s.nodes) {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, n := range s.nodes {
+		if _, err := taskrunner.Applicable(n, s.ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("node [%s]: %v", n.ID(), err))
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			logger.Fail("%s", p)
+		}
+		logger.Fail("Configuration has %d problem(s).", len(problems))
+		return exitFailed
+	}
+	logger.Success("Configuration is valid (%d nodes)", len(s.nodes))
+	return exitOK
+}
+
+func runGraph(args []string) int {
+	fs, f := newFlagSet("graph")
+	format := fs.String("format", "text", "Output format: text or dot")
+	sel := addSelectFlags(fs)
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+	if *format != "text" && *format != "dot" {
+		logger.Fail("Unknown graph format: %s", *format)
+		return exitUsage
+	}
+
+	if *format == "dot" {
+		logger.SetOutput(os.Stderr)
+	}
+
+	f.readOnly = true
+	s := newSession(f, true)
+	if !s.selectNodes(sel) {
+		return exitUsage
+	}
+
+	if *format == "dot" {
+		fmt.Println("digraph dotbuilder {")
+		fmt.Println("  rankdir=LR;")
+	}
+
+	for _, st := range taskrunner.SplitStages(s.nodes) {
+		if len(st.Nodes) == 0 {
+			continue
+		}
+		layers, err := taskrunner.Layers(st.Nodes, s.ctx.Detached)
+		if err != nil {
+			logger.Fail("Stage [%s]: %v", st.Name, err)
+			return exitFailed
+		}
+
+		if *format == "dot" {
+			fmt.Printf("  subgraph \"cluster_%s\" {\n    label=%q;\n", st.Name, st.Name)
+			for _, n := range st.Nodes {
+				fmt.Printf("    %q;\n", n.ID())
+			}
+			fmt.Println("  }")
+			for _, n := range st.Nodes {
+				for _, dep := range n.Deps() {
+					if s.ctx.Detached[dep] {
+						continue
+					}
+					fmt.Printf("  %q -> %q;\n", dep, n.ID())
+				}
+			}
+			continue
+		}
+
+		fmt.Printf("=== Stage: %s ===\n", st.Name)
+		for i, layer := range layers {
+			fmt.Printf("  Layer %d: %s\n", i+1, strings.Join(layer, ", "))
+		}
+	}
+
+	if *format == "dot" {
+		fmt.Println("}")
+	}
+	return exitOK
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"dotbuilder/internal/lockfile"
+	"dotbuilder/internal/taskrunner"
+	"dotbuilder/pkg/logger"
+	"sort"
+	"strings"
+)
+
+func runLock(args []string) int {
+	fs, f := newFlagSet("lock")
+	check := fs.Bool("check", false, "Report drift from the lockfile instead of writing it")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	// Versions are queried from the machine, so this is never a dry-run.
+	s := newSession(f, false)
+	path := lockfile.PathFor(s.configFile)
+	lk, err := lockfile.Load(path)
+	if err != nil {
+		logger.Fail("Failed to load lockfile: %v", err)
+		return exitFailed
+	}
+	key := lockfile.Key(s.sysInfo)
+
+	pkgs := make(map[string]*lockfile.Package)
+	for _, n := range s.all {
+		pn, ok := n.(*taskrunner.PkgNode)
+		if !ok {
+			continue
+		}
+		if applicable, _ := taskrunner.Applicable(n, s.ctx); !applicable {
+			continue
+		}
+		lp, err := s.engine.LockPackage(pn.Pkg)
+		if err != nil {
+			logger.Info("[%s] Not locked: %v", pn.Pkg.Name, err)
+			continue
+		}
+		pkgs[pn.Pkg.Name] = lp
+	}
+
+	if *check {
+		platform := lk.Platforms[key]
+		if platform == nil {
+			logger.Fail("No entries for %s in %s", key, path)
+			return exitDrift
+		}
+		if drift := lockDrift(platform.Packages, pkgs); len(drift) > 0 {
+			for _, d := range drift {
+				logger.Warn("%s", d)
+			}
+			logger.Warn("%d package(s) differ from %s [%s].", len(drift), path, key)
+			return exitDrift
+		}
+		logger.Success("Installed versions match %s [%s]", path, key)
+		return exitOK
+	}
+
+	lk.Set(key, pkgs)
+	if err := lk.Save(); err != nil {
+		logger.Fail("Failed to write lockfile: %v", err)
+		return exitFailed
+	}
+	logger.Success("Locked %d package(s) for %s in %s", len(pkgs), key, path)
+	return exitOK
+}
+
+// lockDrift describes every difference between locked and installed versions.
+func lockDrift(locked, installed map[string]*lockfile.Package) []string {
+	var drift []string
+	for id, lp := range locked {
+		cur, ok := installed[id]
+		if !ok {
+			drift = append(drift, "["+id+"] locked but not installed")
+			continue
+		}
+		for name, v := range lp.Versions {
+			if got := cur.Versions[name]; got != v {
+				drift = append(drift, "["+id+"] "+name+": locked "+v+", installed "+orNone(got))
+			}
+		}
+	}
+	for id := range installed {
+		if _, ok := locked[id]; !ok {
+			drift = append(drift, "["+id+"] installed but not in the lockfile")
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return v
+}
+
+// useLock makes the engine install the versions locked for this machine.
+func (s *session) useLock() bool {
+	path := lockfile.PathFor(s.configFile)
+	lk, err := lockfile.Load(path)
+	if err != nil {
+		logger.Fail("Failed to load lockfile: %v", err)
+		return false
+	}
+	key := lockfile.Key(s.sysInfo)
+	platform := lk.Platforms[key]
+	if platform == nil {
+		logger.Fail("No entries for %s in %s; run 'dotbuilder lock' first", key, path)
+		return false
+	}
+
+	var unlocked []string
+	for _, n := range s.nodes {
+		if pn, ok := n.(*taskrunner.PkgNode); ok && platform.Packages[pn.Pkg.Name] == nil {
+			unlocked = append(unlocked, pn.Pkg.Name)
+		}
+	}
+	if len(unlocked) > 0 {
+		logger.Warn("Not in the lockfile, installing as configured: %s", strings.Join(unlocked, ", "))
+	}
+
+	logger.Info("Using locked versions for %s (generated %s)", key, platform.Generated)
+	s.engine.Locked = platform
+	return true
+}
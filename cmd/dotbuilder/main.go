@@ -2,51 +2,303 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"dotbuilder/internal/config"
 	"dotbuilder/internal/context"
+	"dotbuilder/internal/filemanager"
 	"dotbuilder/internal/pkgmanager"
+	"dotbuilder/internal/secrets"
+	"dotbuilder/internal/state"
 	"dotbuilder/internal/taskrunner"
+	"dotbuilder/internal/tmpl"
+	"dotbuilder/internal/vars"
 	"dotbuilder/pkg/logger"
+	"dotbuilder/pkg/redact"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"text/template"
 	"time"
 )
 
 type flags struct {
 	configFile string
+	stateFile  string
 	debug      bool
 	dryRun     bool
+	prune      bool
+	upgrade    bool
+	locked     bool
+	profiles   []string
+	lenient    bool     // Leave config problems to the caller (validate)
+	readOnly   bool     // Write nothing, not even helper scripts (validate, graph, vars)
+	tmpScripts bool     // Write helper scripts to a directory of their own (status)
+	vars       []string // --var k=v
+}
+
+// Exit codes shared by all subcommands.
+const (
+	exitOK     = 0
+	exitFailed = 1 // Nodes failed or the config is invalid
+	exitUsage  = 2 // Bad command line
+	exitDrift  = 3 // status: the machine differs from the config
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"apply", "Install packages, link files and run tasks", runApply},
+		{"plan", "Show what apply would do (dry-run)", runPlan},
+		{"status", "Compare the machine with the config", runStatus},
+		{"validate", "Load and check the config without touching anything", runValidate},
+		{"graph", "Print the dependency graph", runGraph},
+		{"prune", "Remove files that were removed from the config", runPrune},
+		{"restore", "Put back files backed up by earlier runs", runRestore},
+		{"upgrade", "Upgrade installed packages", runUpgrade},
+		{"uninstall", "Remove packages, honoring reverse dependencies", runUninstall},
+		{"lock", "Record installed package versions in dotbuilder.lock", runLock},
+		{"schema", "Print the JSON Schema of the config format", runSchema},
+		{"vars", "Show variables and where their values come from", runVars},
+	}
 }
 
 func main() {
-	flags := parseFlags()
-	cfg, baseDir := loadConfig(flags.configFile)
-	sysInfo, isRoot, vars := initializeVars(cfg, baseDir)
+	args := os.Args[1:]
+
+	// No subcommand (or only flags) keeps the historical behaviour: apply.
+	name := "apply"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		os.Exit(exitOK)
+	}
+
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(args))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: dotbuilder <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'dotbuilder <command> -h' for command flags.")
+}
+
+// newFlagSet registers the flags shared by every subcommand.
+func newFlagSet(name string) (*flag.FlagSet, *flags) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logger.Error("Failed to get user home directory: %v", err)
+	}
+	defFile := filepath.Join(home, ".dotfiles", "config.yml")
+
+	f := &flags{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&f.configFile, "c", defFile, "Path to configuration file")
+	fs.StringVar(&f.stateFile, "state", state.DefaultPath(), "Path to the state file")
+	fs.BoolVar(&f.debug, "debug", false, "Enable debug logs")
+	if env := os.Getenv("DOTBUILDER_PROFILE"); env != "" {
+		(*listFlag)(&f.profiles).Set(env)
+	}
+	fs.Var((*listFlag)(&f.profiles), "profile", "Apply these profiles (comma-separated, default $DOTBUILDER_PROFILE)")
+	fs.Var((*varFlag)(&f.vars), "var", "Set a variable, overriding every other source (k=v, repeatable)")
+	return fs, f
+}
+
+// listFlag collects comma-separated values; the flag may be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
 
-	// Setup sudo refresh for non-root users
-	if !isRoot && !flags.dryRun {
-		setupSudoRefresh()
+func (l *listFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// varFlag collects k=v assignments; values may contain commas.
+type varFlag []string
+
+func (v *varFlag) String() string { return strings.Join(*v, " ") }
+
+func (v *varFlag) Set(s string) error {
+	if !strings.Contains(s, "=") || strings.HasPrefix(s, "=") {
+		return fmt.Errorf("expected k=v, got %q", s)
+	}
+	*v = append(*v, s)
+	return nil
+}
+
+// addSelectFlags registers the node selection flags on fs.
+func addSelectFlags(fs *flag.FlagSet) *taskrunner.Selector {
+	sel := &taskrunner.Selector{}
+	fs.Var((*listFlag)(&sel.Only), "only", "Only run these node IDs (comma-separated)")
+	fs.Var((*listFlag)(&sel.Skip), "skip", "Skip these node IDs (comma-separated)")
+	fs.Var((*listFlag)(&sel.Tags), "tags", "Only run nodes with any of these tags")
+	fs.Var((*listFlag)(&sel.SkipTags), "skip-tags", "Skip nodes with any of these tags")
+	fs.Var((*listFlag)(&sel.Groups), "groups", "Only run nodes in these groups (boot, default, end)")
+	fs.Var((*listFlag)(&sel.SkipGroups), "skip-groups", "Skip nodes in these groups")
+	fs.BoolVar(&sel.NoDeps, "no-deps", false, "Do not pull in dependencies of selected nodes")
+	return sel
+}
+
+// parseFlags parses args and applies global side effects such as debug logging.
+// Flags may follow positional arguments; everything after "--" is positional.
+func parseFlags(fs *flag.FlagSet, f *flags, args []string) bool {
+	var positional, rest []string
+	for i, a := range args {
+		if a == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return false
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	fs.Parse(append([]string{"--"}, append(positional, rest...)...))
+
+	if f.debug {
+		logger.SetDebug(true)
+	}
+	return true
+}
+
+// session bundles everything derived from the config for one invocation.
+type session struct {
+	runID      string
+	configFile string
+	cfg        *config.Config
+	baseDir    string
+	sysInfo    *context.SystemInfo
+	isRoot     bool
+	vars       map[string]interface{}
+	varStore   *vars.Store // Where each variable came from
+	engine     *pkgmanager.Engine
+	ctx        *taskrunner.Context
+	nodes      []taskrunner.Node // Nodes to run after selection
+	all        []taskrunner.Node // Every node declared in the config
+	tmpScripts string            // Helper scripts removed by close, see flags.tmpScripts
+}
+
+// close removes what the session wrote for itself only.
+func (s *session) close() {
+	if s.tmpScripts != "" {
+		os.RemoveAll(s.tmpScripts)
+	}
+}
+
+// selectNodes narrows s.nodes and records the left-out IDs in the context.
+func (s *session) selectNodes(sel *taskrunner.Selector) bool {
+	nodes, detached, err := taskrunner.Select(s.nodes, *sel)
+	if err != nil {
+		logger.Fail("Invalid selection: %v", err)
+		return false
+	}
+	if len(detached) > 0 {
+		logger.Info("Selected %d of %d nodes.", len(nodes), len(s.nodes))
+	}
+	s.nodes = nodes
+	s.ctx.Detached = detached
+	return true
+}
+
+// loadState reads the state file, aborting on a corrupt one.
+func loadState(f *flags) *state.State {
+	st, err := state.Load(f.stateFile)
+	if err != nil {
+		logger.Error("Failed to load state %s: %v", f.stateFile, err)
+	}
+	return st
+}
+
+// saveState records the results of a real run.
+func saveState(f *flags, s *session, results map[string]taskrunner.NodeResult) {
+	st := loadState(f)
+	st.Config = s.configFile
+	taskrunner.RecordResults(st, s.runID, results, s.nodes, s.ctx)
+	st.Backups = append(st.Backups, s.ctx.Backup.Drain()...)
+	if err := st.Save(); err != nil {
+		logger.Warn("Failed to save state %s: %v", f.stateFile, err)
+		return
+	}
+	logger.Debug("State saved to %s", f.stateFile)
+}
+
+func newSession(f *flags, dryRun bool) *session {
+	cfg, baseDir := loadConfig(f.configFile, f.profiles)
+	if !f.lenient {
+		for _, w := range cfg.Warnings {
+			logger.Warn("%s", w)
+		}
+		if diags := cfg.Validate(); len(diags) > 0 {
+			for _, d := range diags {
+				logger.Fail("%s", d)
+			}
+			logger.Error("Configuration has %d problem(s). Run 'dotbuilder validate' for details.", len(diags))
+		}
+	}
+	tmpl.SetBaseDir(baseDir)
+	if cfg.TemplatesDir != "" {
+		if err := tmpl.LoadPartials(cfg.TemplatesDir); err != nil {
+			logger.Error("Failed to load templates_dir: %v", err)
+		}
+	}
+	sysInfo, isRoot, store := initializeVars(cfg, baseDir, f.vars)
+	vars, err := vars.Resolve(store.Values())
+	if err != nil {
+		logger.Error("Failed to resolve variables: %v", err)
+	}
+	// Secrets register themselves when read; sensitive-looking vars are
+	// known now.
+	for k, v := range vars {
+		if s, ok := v.(string); ok && redact.IsSensitive(k) {
+			redact.Add(s)
+		}
 	}
 
 	logger.Info("Environment: OS=%s, Arch=%s, Distro=%s, PM=%s", sysInfo.OS, sysInfo.Arch, sysInfo.Distro, sysInfo.BasePM)
 
-	// Resolve variables and package definitions
-	resolveVariables(vars)
-	resolvePackageDefs(cfg.Pkgs, vars)
+	if err := resolvePackageDefs(cfg.Pkgs, vars); err != nil {
+		logger.Error("Failed to resolve package definitions: %v", err)
+	}
 
 	// Debug dump
-	if flags.debug {
+	if f.debug {
 		dumpVariables(vars)
 	}
 
 	// Prepare package manager
-	pmEngine := preparePackageManager(cfg, sysInfo, vars, isRoot, flags.dryRun)
+	pmEngine, scriptDir := preparePackageManager(cfg, sysInfo, vars, isRoot, dryRun, f)
 
 	// Create execution context
 	ctx := &taskrunner.Context{
@@ -56,110 +308,130 @@ func main() {
 		BaseDir:    baseDir,
 	}
 
-	// Build task nodes
-	nodes := buildTaskNodes(cfg, pmEngine)
-
-	// Execute tasks
-	results := taskrunner.RunPhased(nodes, ctx)
-	taskrunner.PrintSummary(results, nodes)
-	logger.Success("All build tasks completed")
-}
+	runID := state.NewRunID()
+	ctx.Backup = filemanager.NewBackup(filemanager.DefaultBackupDir(), runID)
 
-func parseFlags() flags {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		logger.Error("Failed to get user home directory: %v", err)
+	nodes := buildTaskNodes(cfg, pmEngine)
+	s := &session{
+		runID:      runID,
+		configFile: absPath(f.configFile),
+		cfg:        cfg,
+		baseDir:    baseDir,
+		sysInfo:    sysInfo,
+		isRoot:     isRoot,
+		vars:       vars,
+		varStore:   store,
+		engine:     pmEngine,
+		ctx:        ctx,
+		nodes:      nodes,
+		all:        nodes,
 	}
-	defFile := filepath.Join(home, ".dotfiles", "config.yml")
-
-	configFile := flag.String("c", defFile, "Path to configuration file")
-	debug := flag.Bool("debug", false, "Enable debug logs")
-	var dryRun bool
-	flag.BoolVar(&dryRun, "n", false, "Dry-run mode")
-	flag.BoolVar(&dryRun, "dry-run", false, "Dry-run mode")
-	flag.Parse()
-
-	if *debug {
-		logger.SetDebug(true)
+	if f.tmpScripts {
+		s.tmpScripts = scriptDir
 	}
+	return s
+}
 
-	return flags{
-		configFile: *configFile,
-		debug:      *debug,
-		dryRun:     dryRun,
+func absPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
 	}
+	return p
 }
 
-func loadConfig(configFile string) (*config.Config, string) {
+func loadConfig(configFile string, profiles []string) (*config.Config, string) {
 	logger.Info("Load configuration: %s", configFile)
 	cfg, err := config.Load(configFile)
 	if err != nil {
 		logger.Error("Failed to load configuration: %v", err)
 	}
 
+	hostname, _ := os.Hostname()
+	applied, err := cfg.ApplyOverlays(profiles, hostname)
+	if err != nil {
+		logger.Error("Failed to apply overlays: %v", err)
+	}
+	if len(applied) > 0 {
+		logger.Info("Overlays: %s", strings.Join(applied, ", "))
+	}
+
 	absConfigPath, err := filepath.Abs(configFile)
 	if err != nil {
 		logger.Error("Failed to resolve config path: %v", err)
 	}
 	baseDir := filepath.Dir(absConfigPath)
 
-	// Ensure Vars map is initialized
-	if cfg.Vars == nil {
-		cfg.Vars = make(map[string]string)
+	return cfg, baseDir
+}
+
+// envVarPrefix marks environment variables imported as template variables.
+const envVarPrefix = "DOTBUILDER_VAR_"
+
+// initializeVars layers the variables from lowest to highest precedence:
+// facts, config file, includes, overlays, env files, DOTBUILDER_VAR_* and --var.
+func initializeVars(cfg *config.Config, baseDir string, cliVars []string) (*context.SystemInfo, bool, *vars.Store) {
+	sysInfo := context.Detect()
+	isRoot := context.IsRoot()
+
+	store := vars.NewStore()
+
+	// Set base directories and system info
+	store.SetAll(vars.LayerFacts, "system", map[string]interface{}{
+		"dotfiles":     baseDir,
+		"OS":           sysInfo.OS,
+		"DISTRO":       sysInfo.Distro,
+		"sys_os":       sysInfo.OS,
+		"sys_distro":   sysInfo.Distro,
+		"sys_arch":     sysInfo.Arch,
+		"sys_pm":       sysInfo.BasePM,
+		"sys_home":     sysInfo.Home,
+		"sys_user":     sysInfo.User,
+		"sys_hostname": sysInfo.Hostname,
+		"home":         sysInfo.Home,
+		"user":         sysInfo.User,
+	})
+
+	for _, src := range cfg.VarSources {
+		store.SetAll(src.Layer, src.Name, src.Vars)
+	}
+
+	// Secrets are only fetched when a template prints them
+	for name, sec := range secrets.Lazy(cfg.Secrets) {
+		store.Set(vars.LayerConfig, "secrets:"+cfg.Secrets[name].Origin.File, name, sec)
 	}
 
 	// Load environment files
-	envFiles := []string{
+	seen := make(map[string]bool)
+	for _, ef := range []string{
 		filepath.Join(baseDir, "my.env"),
 		filepath.Join(baseDir, ".env"),
 		"my.env",
 		".env",
+	} {
+		ef = absPath(ef)
+		if seen[ef] {
+			continue
+		}
+		seen[ef] = true
+		envVars := make(map[string]interface{})
+		loadEnvFile(ef, envVars)
+		store.SetAll(vars.LayerEnvFile, ef, envVars)
 	}
 
-	for _, ef := range envFiles {
-		loadEnvFile(ef, cfg.Vars)
-	}
-
-	// Load system environment variables
+	// Only explicitly prefixed environment variables are imported
 	for _, e := range os.Environ() {
 		pair := strings.SplitN(e, "=", 2)
-		if len(pair) == 2 {
-			cfg.Vars[pair[0]] = pair[1]
+		if len(pair) == 2 && strings.HasPrefix(pair[0], envVarPrefix) && len(pair[0]) > len(envVarPrefix) {
+			store.Set(vars.LayerEnv, pair[0], strings.TrimPrefix(pair[0], envVarPrefix), pair[1])
 		}
 	}
 
-	return cfg, baseDir
-}
-
-func initializeVars(cfg *config.Config, baseDir string) (*context.SystemInfo, bool, map[string]string) {
-	sysInfo := context.Detect()
-	isRoot := context.IsRoot()
-
-	vars := cfg.Vars
-	if vars == nil {
-		vars = make(map[string]string)
-	}
-
-	// Set base directories and system info
-	vars["dotfiles"] = baseDir
-	vars["OS"] = sysInfo.OS
-	vars["DISTRO"] = sysInfo.Distro
-	vars["sys_os"] = sysInfo.OS
-	vars["sys_distro"] = sysInfo.Distro
-	vars["sys_arch"] = sysInfo.Arch
-	vars["sys_pm"] = sysInfo.BasePM
-	vars["sys_home"] = sysInfo.Home
-	vars["sys_user"] = sysInfo.User
-
-	// Set defaults if not already set
-	if _, ok := vars["home"]; !ok {
-		vars["home"] = sysInfo.Home
-	}
-	if _, ok := vars["user"]; !ok {
-		vars["user"] = sysInfo.User
+	for _, kv := range cliVars {
+		pair := strings.SplitN(kv, "=", 2)
+		store.Set(vars.LayerCLI, "--var", pair[0], pair[1])
 	}
 
-	return sysInfo, isRoot, vars
+	return sysInfo, isRoot, store
 }
 
 func setupSudoRefresh() {
@@ -176,25 +448,30 @@ func setupSudoRefresh() {
 	}()
 }
 
-func dumpVariables(vars map[string]string) {
+func dumpVariables(vars map[string]interface{}) {
 	logger.Debug("------ FINAL VARIABLES DUMP ------")
 	for k, v := range vars {
-		displayVal := v
-		lowerK := strings.ToLower(k)
-		if shouldMask(lowerK) {
-			if len(v) > 3 {
-				displayVal = v[:3] + "***"
-			} else {
-				displayVal = "***"
-			}
-		}
-		logger.Debug("[%s] = %s", k, displayVal)
+		logger.Debug("[%s] = %s", k, displayVar(k, v))
 	}
 	logger.Debug("----------------------------------")
 }
 
-func preparePackageManager(cfg *config.Config, sysInfo *context.SystemInfo, vars map[string]string, isRoot, dryRun bool) *pkgmanager.Engine {
-	scriptDir, err := pkgmanager.Prepare(cfg.Scrpits, vars)
+// preparePackageManager writes the helper scripts as f asks and returns
+// the engine with them on its PATH, and their directory.
+func preparePackageManager(cfg *config.Config, sysInfo *context.SystemInfo, vars map[string]interface{}, isRoot, dryRun bool, f *flags) (*pkgmanager.Engine, string) {
+	var scriptDir string
+	var err error
+	switch {
+	case f.readOnly:
+		// Parse only: rendering could read secrets and writing replaces
+		// the scripts of a run in progress.
+		err = pkgmanager.CheckScripts(cfg.Scrpits)
+	case f.tmpScripts:
+		// Checks may call the scripts; a run in progress keeps its own.
+		scriptDir, err = pkgmanager.PrepareTemp(cfg.Scrpits, vars)
+	default:
+		scriptDir, err = pkgmanager.Prepare(cfg.Scrpits, vars)
+	}
 	if err != nil {
 		logger.Error("Failed to prepare helper scripts: %v", err)
 	}
@@ -209,7 +486,7 @@ func preparePackageManager(cfg *config.Config, sysInfo *context.SystemInfo, vars
 		logger.Debug("Injected scripts to PATH: %s", scriptDir)
 	}
 
-	return pmEngine
+	return pmEngine, scriptDir
 }
 
 func buildTaskNodes(cfg *config.Config, pmEngine *pkgmanager.Engine) []taskrunner.Node {
@@ -217,10 +494,7 @@ func buildTaskNodes(cfg *config.Config, pmEngine *pkgmanager.Engine) []taskrunne
 
 	// 1. Files -> Nodes
 	for i, f := range cfg.Files {
-		id := f.ID
-		if id == "" {
-			id = f.Dest
-		}
+		id := f.NodeID()
 		if id == "" {
 			id = fmt.Sprintf("file_%d", i)
 		}
@@ -250,70 +524,28 @@ func buildTaskNodes(cfg *config.Config, pmEngine *pkgmanager.Engine) []taskrunne
 	return nodes
 }
 
-func resolveVariables(vars map[string]string) {
-	for pass := 0; pass < 100; pass++ {
-		changed := false
-		for k, v := range vars {
-			if len(v) < 3 {
-				continue
-			}
-
-			if !bytes.Contains([]byte(v), []byte("{{")) {
-				continue
-			}
-
-			tmpl, err := template.New("var").Parse(v)
-			if err != nil {
-				continue
-			}
-
-			var buf bytes.Buffer
-			data := map[string]interface{}{"vars": vars}
-
-			if err := tmpl.Execute(&buf, data); err == nil {
-				newVal := buf.String()
-				if newVal != v {
-					vars[k] = newVal
-					changed = true
-				}
-			}
-		}
-		if !changed {
-			break
-		}
-	}
-}
-
-func resolvePackageDefs(pkgs []config.Package, vars map[string]string) {
-	data := map[string]interface{}{"vars": vars}
-
-	render := func(s string) string {
-		if !bytes.Contains([]byte(s), []byte("{{")) {
-			return s
-		}
-		tmpl, err := template.New("p").Parse(s)
-		if err != nil {
-			return s
+// resolvePackageDefs renders the names of every package against the
+// resolved vars.
+func resolvePackageDefs(pkgs []config.Package, vals map[string]interface{}) error {
+	for i := range pkgs {
+		p := &pkgs[i]
+		var err error
+		if p.Name, err = vars.Render("name", p.Name, vals); err != nil {
+			return fmt.Errorf("package [%s]: %w", p.NodeID(), err)
 		}
-		var buf bytes.Buffer
-		if err := tmpl.Execute(&buf, data); err == nil {
-			return buf.String()
+		if p.Def, err = vars.Render("def", p.Def, vals); err != nil {
+			return fmt.Errorf("package [%s]: %w", p.NodeID(), err)
 		}
-		return s
-	}
-
-	for i := range pkgs {
-		pkgs[i].Name = render(pkgs[i].Name)
-		pkgs[i].Def = render(pkgs[i].Def)
-
-		// Map values
-		for k, v := range pkgs[i].Map {
-			pkgs[i].Map[k] = render(v)
+		for k, v := range p.Map {
+			if p.Map[k], err = vars.Render("map."+k, v, vals); err != nil {
+				return fmt.Errorf("package [%s]: %w", p.NodeID(), err)
+			}
 		}
 	}
+	return nil
 }
 
-func loadEnvFile(path string, vars map[string]string) {
+func loadEnvFile(path string, vars map[string]interface{}) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return
 	}
@@ -348,13 +580,3 @@ func loadEnvFile(path string, vars map[string]string) {
 		}
 	}
 }
-
-func shouldMask(key string) bool {
-	sensitive := []string{"secret", "key", "token", "password", "pwd", "auth"}
-	for _, s := range sensitive {
-		if strings.Contains(key, s) {
-			return true
-		}
-	}
-	return false
-}
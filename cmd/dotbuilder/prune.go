@@ -0,0 +1,80 @@
+package main
+
+import (
+	"dotbuilder/internal/filemanager"
+	"dotbuilder/internal/state"
+	"dotbuilder/internal/taskrunner"
+	"dotbuilder/pkg/logger"
+)
+
+func runPrune(args []string) int {
+	fs, f := newFlagSet("prune")
+	fs.BoolVar(&f.dryRun, "n", false, "Dry-run mode")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Dry-run mode")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	s := newSession(f, f.dryRun)
+	return prune(f, s)
+}
+
+// prune removes files recorded in the state that the config no longer
+// declares, either by node ID or by destination.
+func prune(f *flags, s *session) int {
+	st := loadState(f)
+
+	pruned, kept := 0, 0
+	declaredIDs := make(map[string]bool)
+	declaredDests := make(map[string]bool)
+	for _, n := range s.all {
+		declaredIDs[n.ID()] = true
+		if fn, ok := n.(*taskrunner.FileNode); ok {
+			_, dest, err := filemanager.ResolvePaths(fn.File, s.vars, s.baseDir)
+			if err != nil {
+				// Its own entry is kept by ID; other entries are still checked.
+				logger.Fail("[%s] %v", fn.ID(), err)
+				kept++
+				continue
+			}
+			declaredDests[dest] = true
+		}
+	}
+
+	var fsys filemanager.FileSystem = filemanager.RealFS{}
+	if f.dryRun {
+		fsys = filemanager.DryRunFS{}
+	}
+
+	for _, e := range st.Sorted() {
+		if e.Kind != state.KindFile || declaredIDs[e.ID] || declaredDests[e.Dest] {
+			continue
+		}
+
+		forget, err := filemanager.PruneOrphan(e, fsys, s.baseDir, s.ctx.Backup)
+		if err != nil {
+			logger.Warn("[%s] %s: %v", e.ID, e.Dest, err)
+			kept++
+		}
+		if forget {
+			pruned++
+			if !f.dryRun {
+				st.Forget(e.ID)
+			}
+		}
+	}
+
+	if !f.dryRun && pruned > 0 {
+		st.Backups = append(st.Backups, s.ctx.Backup.Drain()...)
+		if err := st.Save(); err != nil {
+			logger.Warn("Failed to save state %s: %v", f.stateFile, err)
+		}
+	}
+
+	if kept > 0 {
+		logger.Warn("Pruned %d orphaned file(s), left %d in place.", pruned, kept)
+		return exitFailed
+	}
+	logger.Success("Pruned %d orphaned file(s).", pruned)
+	return exitOK
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"dotbuilder/internal/filemanager"
+	"dotbuilder/internal/state"
+	"dotbuilder/pkg/logger"
+	"fmt"
+)
+
+func runRestore(args []string) int {
+	fs, f := newFlagSet("restore")
+	fs.BoolVar(&f.dryRun, "n", false, "Dry-run mode")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Dry-run mode")
+	runID := fs.String("run", "", "Restore every file backed up during this run")
+	list := fs.Bool("list", false, "List recorded backups")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	st := loadState(f)
+
+	if *list {
+		if len(st.Backups) == 0 {
+			logger.Info("No backups recorded in %s", f.stateFile)
+		}
+		for _, b := range st.Backups {
+			fmt.Printf("%s  %-20s %s -> %s\n", b.RunID, b.ID, b.Dest, b.Path)
+		}
+		return exitOK
+	}
+
+	var recs []state.Backup
+	switch {
+	case *runID != "" && fs.NArg() == 0:
+		recs = st.RunBackups(*runID)
+		if len(recs) == 0 {
+			logger.Fail("No backups recorded for run %s", *runID)
+			return exitFailed
+		}
+	case *runID == "" && fs.NArg() > 0:
+		for _, id := range fs.Args() {
+			b, ok := st.LatestBackup(id)
+			if !ok {
+				logger.Fail("No backup recorded for [%s]", id)
+				return exitFailed
+			}
+			recs = append(recs, b)
+		}
+	default:
+		logger.Fail("Usage: dotbuilder restore [-n] (-run <run id> | <file id>...)")
+		return exitUsage
+	}
+
+	var fsys filemanager.FileSystem = filemanager.RealFS{}
+	if f.dryRun {
+		fsys = filemanager.DryRunFS{}
+	}
+	bk := filemanager.NewBackup(filemanager.DefaultBackupDir(), state.NewRunID())
+
+	failed := 0
+	for _, rec := range recs {
+		if err := bk.Restore(fsys, rec); err != nil {
+			logger.Warn("[%s] Failed to restore %s: %v", rec.ID, rec.Dest, err)
+			failed++
+			continue
+		}
+		if !f.dryRun {
+			st.DropBackup(rec.Path)
+		}
+	}
+
+	if !f.dryRun {
+		st.Backups = append(st.Backups, bk.Drain()...)
+		if err := st.Save(); err != nil {
+			logger.Warn("Failed to save state %s: %v", f.stateFile, err)
+		}
+	}
+
+	if failed > 0 {
+		return exitFailed
+	}
+	logger.Success("Restored %d file(s).", len(recs))
+	return exitOK
+}
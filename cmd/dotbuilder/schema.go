@@ -0,0 +1,36 @@
+package main
+
+import (
+	"dotbuilder/internal/config"
+	"dotbuilder/pkg/logger"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	out := fs.String("o", "", "Write the schema to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	data, err := json.MarshalIndent(config.JSONSchema(), "", "  ")
+	if err != nil {
+		logger.Fail("Failed to encode schema: %v", err)
+		return exitFailed
+	}
+	data = append(data, '\n')
+
+	if *out == "" {
+		fmt.Print(string(data))
+		return exitOK
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		logger.Fail("Failed to write schema: %v", err)
+		return exitFailed
+	}
+	logger.Success("Schema written to %s", *out)
+	return exitOK
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"dotbuilder/internal/dag"
+	"dotbuilder/internal/taskrunner"
+	"dotbuilder/pkg/logger"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func runUninstall(args []string) int {
+	fs, f := newFlagSet("uninstall")
+	fs.BoolVar(&f.dryRun, "n", false, "Dry-run mode")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Dry-run mode")
+	cascade := fs.Bool("cascade", false, "Also uninstall packages that depend on the given ones")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		logger.Fail("Usage: dotbuilder uninstall [-n] [-cascade] <pkg>...")
+		return exitUsage
+	}
+
+	s := newSession(f, f.dryRun)
+
+	g := dag.New()
+	nodeMap := make(map[string]taskrunner.Node)
+	for _, n := range s.all {
+		nodeMap[n.ID()] = n
+		for _, dep := range n.Deps() {
+			g.AddEdge(dep, n.ID())
+		}
+	}
+
+	targets := make(map[string]bool)
+	for _, id := range fs.Args() {
+		if _, ok := nodeMap[id].(*taskrunner.PkgNode); !ok {
+			logger.Fail("[%s] is not a declared package", id)
+			return exitUsage
+		}
+		targets[id] = true
+	}
+
+	// Reverse dependencies: packages are removed with -cascade, anything else
+	// is only reported since it cannot be uninstalled.
+	var blocking []string
+	for _, id := range g.Descendants(fs.Args()) {
+		if _, isPkg := nodeMap[id].(*taskrunner.PkgNode); !isPkg {
+			logger.Warn("[%s] depends on a package being removed", id)
+			continue
+		}
+		if *cascade {
+			targets[id] = true
+		} else {
+			blocking = append(blocking, id)
+		}
+	}
+	if len(blocking) > 0 {
+		logger.Fail("Packages still depend on the selection: %s (use -cascade)", strings.Join(blocking, ", "))
+		return exitFailed
+	}
+
+	var ids []string
+	var nodes []taskrunner.Node
+	for _, n := range s.all {
+		if targets[n.ID()] {
+			ids = append(ids, n.ID())
+			nodes = append(nodes, n)
+		}
+	}
+
+	// Order only by edges between targets; SortLayers counts every parent.
+	sub := dag.New()
+	for _, n := range nodes {
+		for _, dep := range n.Deps() {
+			if targets[dep] {
+				sub.AddEdge(dep, n.ID())
+			}
+		}
+	}
+	layers, err := sub.SortLayers(ids)
+	if err != nil {
+		logger.Fail("%v", err)
+		return exitFailed
+	}
+
+	if !s.isRoot && !f.dryRun {
+		setupSudoRefresh()
+	}
+
+	dependents := make(map[string][]string)
+	for _, n := range nodes {
+		for _, dep := range n.Deps() {
+			dependents[dep] = append(dependents[dep], n.ID())
+		}
+	}
+
+	// Dependents go first, so walk the layers backwards. A package stays when
+	// one of its dependents could not be removed.
+	results := make(map[string]taskrunner.NodeResult)
+	for i := len(layers) - 1; i >= 0; i-- {
+	nextID:
+		for _, id := range layers[i] {
+			for _, d := range dependents[id] {
+				if st := results[d].Status; st == taskrunner.StatusFailed || st == taskrunner.StatusBlocked {
+					results[id] = taskrunner.NodeResult{
+						ID:        id,
+						Status:    taskrunner.StatusBlocked,
+						Error:     fmt.Errorf("dependent '%s' was not removed", d),
+						Timestamp: time.Now(),
+					}
+					continue nextID
+				}
+			}
+			start := time.Now()
+			err := s.engine.Uninstall(nodeMap[id].(*taskrunner.PkgNode).Pkg)
+			results[id] = taskrunner.NewResult(id, start, err)
+		}
+	}
+
+	if !f.dryRun {
+		st := loadState(f)
+		for id, res := range results {
+			if res.Status == taskrunner.StatusSuccess || res.Status == taskrunner.StatusSkipped {
+				st.Forget(id)
+			}
+		}
+		if err := st.Save(); err != nil {
+			logger.Warn("Failed to save state %s: %v", f.stateFile, err)
+		}
+	}
+
+	if taskrunner.PrintSummary(results, nodes) > 0 {
+		return exitFailed
+	}
+	logger.Success("Uninstall completed")
+	return exitOK
+}
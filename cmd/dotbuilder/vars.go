@@ -0,0 +1,70 @@
+package main
+
+import (
+	"dotbuilder/internal/vars"
+	"dotbuilder/pkg/logger"
+	"dotbuilder/pkg/redact"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func runVars(args []string) int {
+	fs, f := newFlagSet("vars")
+	explain := fs.Bool("explain", false, "Show every source that set a variable, in precedence order")
+	if !parseFlags(fs, f, args) {
+		return exitUsage
+	}
+
+	// Keep stdout for the listing.
+	logger.SetOutput(os.Stderr)
+	f.readOnly = true
+	s := newSession(f, true)
+
+	names := fs.Args()
+	if len(names) == 0 {
+		names = s.varStore.Keys()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*explain {
+		fmt.Fprintln(w, "NAME\tVALUE\tLAYER\tSOURCE")
+	}
+	for _, name := range names {
+		win, ok := s.varStore.Winner(name)
+		if !ok {
+			logger.Fail("Unknown variable: %s", name)
+			return exitUsage
+		}
+		if !*explain {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, displayVar(name, s.vars[name]), win.Layer, win.Source)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s = %s\n", name, displayVar(name, s.vars[name]))
+		history := s.varStore.History(name)
+		for i := len(history) - 1; i >= 0; i-- {
+			o := history[i]
+			mark := "overridden"
+			if i == len(history)-1 {
+				mark = "in effect"
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t(%s)\n", o.Layer, o.Source, displayVar(name, o.Value), mark)
+		}
+	}
+	w.Flush()
+	return exitOK
+}
+
+// displayVar coerces a value to text, hides secret values in it and masks
+// it entirely for sensitive-looking names.
+func displayVar(name string, v interface{}) string {
+	value := redact.String(vars.String(v))
+	if !redact.IsSensitive(name) {
+		return value
+	}
+	if len(value) > 3 {
+		return value[:3] + "***"
+	}
+	return "***"
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// decoder turns a config file into a YAML node, so every format goes through
+// the same unmarshalers, merging and diagnostics.
+type decoder func(data []byte) (*yaml.Node, error)
+
+// decoders are chosen by file extension; anything else is read as YAML.
+var decoders = map[string]decoder{
+	".yml":  decodeYAML,
+	".yaml": decodeYAML,
+	".json": decodeJSON,
+	".toml": decodeTOML,
+}
+
+func decoderFor(path string) decoder {
+	if d, ok := decoders[strings.ToLower(filepath.Ext(path))]; ok {
+		return d
+	}
+	return decodeYAML
+}
+
+// isConfigFile reports whether a directory include should pick up a file.
+func isConfigFile(name string) bool {
+	_, ok := decoders[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+func decodeYAML(data []byte) (*yaml.Node, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// decodeJSON checks the syntax with encoding/json for precise errors, then
+// reads the document as YAML, which keeps line numbers.
+func decodeJSON(data []byte) (*yaml.Node, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("line %d: %w", lineOf(data, se.Offset), err)
+		}
+		return nil, err
+	}
+	return decodeYAML(data)
+}
+
+func decodeTOML(data []byte) (*yaml.Node, error) {
+	var v map[string]interface{}
+	if _, err := toml.Decode(string(data), &v); err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := node.Encode(v); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
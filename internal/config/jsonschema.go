@@ -0,0 +1,189 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// schemaDocs describes config keys in the generated JSON Schema, keyed by
+// "Type.key".
+var schemaDocs = map[string]string{
+	"Config.include":       "Files or directories merged before this file",
+	"Config.vars":          "Template variables (strings, numbers, booleans, lists or maps), available as {{.vars.name}}",
+	"Config.secrets":       "Variables read from encrypted files or commands when first used; masked in output",
+	"Config.scripts":       "Named shell snippets",
+	"Config.templates_dir": "Directory of shared snippets, each file usable in any template as {{template \"name\" .}} (name = path without extension)",
+	"Config.profiles":      "Overlays applied with --profile",
+	"Config.hosts":         "Overlays applied when the hostname matches (globs allowed)",
+
+	"Package.name":    "Package name and node ID",
+	"Package.map":     "Name per distro or package manager; values may be {name, version}",
+	"Package.def":     "Default name when no map entry matches",
+	"Package.version": "Exact version (1.2.3) or constraint (>=1.4)",
+	"Package.manager": "Package manager(s), separated by ';'",
+	"Package.pm":      "Alias for manager",
+	"Package.ignore":  "Do not fail the run if the install fails",
+	"Package.check":   "Command that succeeds when installed; {{.super.check}} is the PM check",
+	"Package.exec":    "Custom install command",
+	"Package.pmi":     "Install template when this package acts as a package manager",
+	"Package.pmc":     "Check template when this package acts as a package manager",
+	"Package.pmu":     "Upgrade template when this package acts as a package manager",
+	"Package.pmr":     "Remove template when this package acts as a package manager",
+	"Package.upd":     "Upgrade command; as a package manager, the command updating its metadata",
+	"Package.clean":   "Uninstall command",
+	"Package.group":   "Stage: boot, default or end; selected with --groups",
+
+	"File.id":          "Node ID, defaults to dest",
+	"File.src":         "Source, relative to the config directory",
+	"File.dest":        "Destination",
+	"File.override":    "Replace an existing destination",
+	"File.check":       "Command that succeeds when the file is in place",
+	"File.append":      "Append the source to the destination",
+	"File.override_if": "Command that allows replacing an existing destination",
+	"File.tpl":         "Render the source as a template (same as mode: template)",
+	"File.mode":        "link (default), copy, template or hardlink",
+	"File.perm":        "Octal permissions of copies and templates; copies keep the source's by default",
+	"File.group":       "Stage: boot, default or end; selected with --groups",
+	"File.backup":      "true, false or a backup directory",
+
+	"Secret.cmd":      "Command printing the secret, e.g. pass show github/token",
+	"Secret.file":     "age (.age) or GPG (.gpg, .asc) encrypted file, relative to the declaring config",
+	"Secret.identity": "age identity file (default ~/.config/age/keys.txt)",
+
+	"Task.id":    "Node ID",
+	"Task.vars":  "Variables for this task, of any type",
+	"Task.check": "Command that succeeds when the task is done",
+	"Task.on":    "Action per check outcome: success or fail mapped to skip or run",
+	"Task.run":   "Command to run",
+	"Task.group": "Stage: boot, default or end; selected with --groups",
+
+	"deps":  "IDs of nodes that must succeed first",
+	"tags":  "Tags for --tags and --skip-tags",
+	"when":  "Condition on facts (sys_os, sys_distro, sys_arch, hostname) and vars.*",
+	"merge": "How to combine with an earlier definition of the same ID",
+}
+
+// JSONSchema returns a JSON Schema (draft-07) for the config format,
+// generated from the config types so it follows them as they change.
+func JSONSchema() map[string]interface{} {
+	g := &schemaGen{defs: make(map[string]interface{})}
+	root := g.object(reflect.TypeOf(Config{}))
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["title"] = "dotbuilder config"
+	root["definitions"] = g.defs
+	return root
+}
+
+type schemaGen struct {
+	defs map[string]interface{}
+}
+
+func (g *schemaGen) ref(t reflect.Type) map[string]interface{} {
+	if _, ok := g.defs[t.Name()]; !ok {
+		g.defs[t.Name()] = nil // Guards recursion
+		g.defs[t.Name()] = g.named(t)
+	}
+	return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+}
+
+// named covers types that decode from more than one YAML shape.
+func (g *schemaGen) named(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(Package{}):
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "string", "description": "Package name"},
+				g.object(t),
+			},
+		}
+	case reflect.TypeOf(BackupSpec{}):
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "boolean"},
+				map[string]interface{}{"type": "string", "description": "Backup directory"},
+			},
+		}
+	}
+	return g.object(t)
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		var s map[string]interface{}
+		switch {
+		case t == reflect.TypeOf(Package{}) && key == "map":
+			s = map[string]interface{}{
+				"type": "object",
+				"additionalProperties": map[string]interface{}{
+					"oneOf": []interface{}{
+						map[string]interface{}{"type": "string"},
+						map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"name":    map[string]interface{}{"type": "string"},
+								"version": map[string]interface{}{"type": "string"},
+							},
+							"required":             []string{"name"},
+							"additionalProperties": false,
+						},
+					},
+				},
+			}
+		case key == "merge":
+			s = map[string]interface{}{"type": "string", "enum": []string{MergeDeep, MergeReplace, MergeRemove}}
+		case t.Name() == "File" && key == "mode":
+			s = map[string]interface{}{"type": "string", "enum": []string{FileLink, FileCopy, FileTemplate, FileHardlink}}
+		case key == "group":
+			s = map[string]interface{}{"type": "string", "enum": []string{"boot", "default", "end"}}
+		default:
+			s = g.typeSchema(f.Type)
+		}
+
+		if doc, ok := schemaDocs[t.Name()+"."+key]; ok {
+			s = withDescription(s, doc)
+		} else if doc, ok := schemaDocs[key]; ok {
+			s = withDescription(s, doc)
+		}
+		props[key] = s
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func withDescription(s map[string]interface{}, doc string) map[string]interface{} {
+	out := map[string]interface{}{"description": doc}
+	for k, v := range s {
+		out[k] = v
+	}
+	return out
+}
+
+func (g *schemaGen) typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		return g.ref(t)
+	}
+	return map[string]interface{}{}
+}
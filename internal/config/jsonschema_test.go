@@ -0,0 +1,91 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var schemaTypes = []reflect.Type{
+	reflect.TypeOf(Config{}),
+	reflect.TypeOf(Package{}),
+	reflect.TypeOf(File{}),
+	reflect.TypeOf(Task{}),
+	reflect.TypeOf(Meta{}),
+	reflect.TypeOf(Overlay{}),
+	reflect.TypeOf(Secret{}),
+}
+
+// yamlKeys returns the yaml keys of a struct type.
+func yamlKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// schemaProperties finds the properties of the object schema generated for t.
+func schemaProperties(t *testing.T, schema map[string]interface{}, typ reflect.Type) map[string]interface{} {
+	t.Helper()
+	s := schema
+	if typ != reflect.TypeOf(Config{}) {
+		defs := schema["definitions"].(map[string]interface{})
+		def, ok := defs[typ.Name()].(map[string]interface{})
+		if !ok {
+			t.Fatalf("no definition for %s", typ.Name())
+		}
+		s = def
+		if alts, ok := def["oneOf"].([]interface{}); ok {
+			for _, alt := range alts {
+				if m := alt.(map[string]interface{}); m["type"] == "object" {
+					s = m
+				}
+			}
+		}
+	}
+	props, ok := s["properties"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("definition of %s has no properties", typ.Name())
+	}
+	return props
+}
+
+func TestJSONSchemaCoversFields(t *testing.T) {
+	schema := JSONSchema()
+	for _, typ := range schemaTypes {
+		props := schemaProperties(t, schema, typ)
+		keys := yamlKeys(typ)
+		for _, key := range keys {
+			if _, ok := props[key]; !ok {
+				t.Errorf("%s.%s is missing from the schema", typ.Name(), key)
+			}
+		}
+		if len(props) != len(keys) {
+			t.Errorf("%s: schema has %d properties, type has %d yaml keys", typ.Name(), len(props), len(keys))
+		}
+	}
+}
+
+func TestSchemaDocsMatchFields(t *testing.T) {
+	fields := make(map[string]bool)
+	anyType := make(map[string]bool)
+	for _, typ := range schemaTypes {
+		for _, key := range yamlKeys(typ) {
+			fields[typ.Name()+"."+key] = true
+			anyType[key] = true
+		}
+	}
+	for doc := range schemaDocs {
+		if strings.Contains(doc, ".") {
+			if !fields[doc] {
+				t.Errorf("schemaDocs[%q] does not match a field", doc)
+			}
+		} else if !anyType[doc] {
+			t.Errorf("schemaDocs[%q] does not match a field of any type", doc)
+		}
+	}
+}
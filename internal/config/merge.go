@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Merge modes for a node that redefines an earlier one with the same ID.
+const (
+	MergeDeep    = "merge"   // Set fields override, lists and maps are combined (default)
+	MergeReplace = "replace" // The later definition wins as a whole
+	MergeRemove  = "remove"  // Drop the earlier definition
+)
+
+func checkMergeMode(kind, id, mode string) error {
+	switch mode {
+	case "", MergeDeep, MergeReplace, MergeRemove:
+		return nil
+	}
+	return fmt.Errorf("%s [%s]: unknown merge mode '%s' (want %s, %s or %s)", kind, id, mode, MergeReplace, MergeDeep, MergeRemove)
+}
+
+func mergePkgs(base, incoming []Package, warnings *[]Diagnostic) ([]Package, error) {
+	for _, p := range incoming {
+		id := p.NodeID()
+		if err := checkMergeMode("package", id, p.Merge); err != nil {
+			return nil, err
+		}
+		i := -1
+		for j := range base {
+			if base[j].NodeID() == id {
+				i = j
+				break
+			}
+		}
+		switch {
+		case i < 0 && p.Merge == MergeRemove:
+			*warnings = append(*warnings, unknownRemove("package", id, p.Origin))
+		case i < 0:
+			p.Merge = ""
+			base = append(base, p)
+		case p.Merge == MergeRemove:
+			base = append(base[:i], base[i+1:]...)
+		case p.Merge == MergeReplace:
+			p.Merge = ""
+			base[i] = p
+		default:
+			deepMerge(&base[i], &p, p.keys)
+			base[i].keys = unionKeys(base[i].keys, p.keys)
+		}
+	}
+	return base, nil
+}
+
+func mergeFiles(base, incoming []File, warnings *[]Diagnostic) ([]File, error) {
+	for _, f := range incoming {
+		id := f.NodeID()
+		if err := checkMergeMode("file", id, f.Merge); err != nil {
+			return nil, err
+		}
+		i := -1
+		for j := range base {
+			if id != "" && base[j].NodeID() == id {
+				i = j
+				break
+			}
+		}
+		switch {
+		case i < 0 && f.Merge == MergeRemove:
+			*warnings = append(*warnings, unknownRemove("file", id, f.Origin))
+		case i < 0:
+			f.Merge = ""
+			base = append(base, f)
+		case f.Merge == MergeRemove:
+			base = append(base[:i], base[i+1:]...)
+		case f.Merge == MergeReplace:
+			f.Merge = ""
+			base[i] = f
+		default:
+			deepMerge(&base[i], &f, f.keys)
+			base[i].keys = unionKeys(base[i].keys, f.keys)
+		}
+	}
+	return base, nil
+}
+
+func mergeTasks(base, incoming []Task, warnings *[]Diagnostic) ([]Task, error) {
+	for _, t := range incoming {
+		if err := checkMergeMode("task", t.ID, t.Merge); err != nil {
+			return nil, err
+		}
+		i := -1
+		for j := range base {
+			if base[j].ID == t.ID {
+				i = j
+				break
+			}
+		}
+		switch {
+		case i < 0 && t.Merge == MergeRemove:
+			*warnings = append(*warnings, unknownRemove("task", t.ID, t.Origin))
+		case i < 0:
+			t.Merge = ""
+			base = append(base, t)
+		case t.Merge == MergeRemove:
+			base = append(base[:i], base[i+1:]...)
+		case t.Merge == MergeReplace:
+			t.Merge = ""
+			base[i] = t
+		default:
+			deepMerge(&base[i], &t, t.keys)
+			base[i].keys = unionKeys(base[i].keys, t.keys)
+		}
+	}
+	return base, nil
+}
+
+// unknownRemove warns about `merge: remove` for an ID nothing defined
+// before, most likely a typo that would otherwise do nothing.
+func unknownRemove(kind, id string, o Origin) Diagnostic {
+	return Diagnostic{o, fmt.Sprintf("%s [%s]: 'merge: remove' but no earlier definition has this ID", kind, id)}
+}
+
+// deepMerge copies every set field of src onto dst: scalars override, maps
+// are merged key by key, lists are combined without duplicates and nested
+// structs are merged recursively. Both must be pointers to the same struct.
+// keys are the yaml keys written for src; a written scalar overrides even
+// when zero, so an overlay can turn `override` or `when` back off.
+func deepMerge(dst, src interface{}, keys map[string]bool) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		field := s.Type().Field(i)
+		if !d.Field(i).CanSet() || field.Name == "Merge" || field.Name == "Origin" {
+			continue
+		}
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		switch kind := field.Type.Kind(); {
+		case keys[key] && kind != reflect.Map && kind != reflect.Slice:
+			d.Field(i).Set(s.Field(i))
+		default:
+			mergeValue(d.Field(i), s.Field(i))
+		}
+	}
+}
+
+// unionKeys keeps the written keys of every definition merged into a node,
+// for when the merged node is merged again.
+func unionKeys(a, b map[string]bool) map[string]bool {
+	if len(b) == 0 {
+		return a
+	}
+	out := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		out[k] = true
+	}
+	for k := range b {
+		out[k] = true
+	}
+	return out
+}
+
+func mergeValue(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			// The merged node keeps the origin of its first definition.
+			if name := src.Type().Field(i).Name; !dst.Field(i).CanSet() || name == "Merge" || name == "Origin" {
+				continue
+			}
+			mergeValue(dst.Field(i), src.Field(i))
+		}
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(src.Type()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			dst.SetMapIndex(iter.Key(), iter.Value())
+		}
+	case reflect.Slice:
+		for i := 0; i < src.Len(); i++ {
+			item := src.Index(i)
+			found := false
+			for j := 0; j < dst.Len(); j++ {
+				if reflect.DeepEqual(dst.Index(j).Interface(), item.Interface()) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				dst.Set(reflect.Append(dst, item))
+			}
+		}
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"dotbuilder/internal/vars"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Overlay is a `profiles:` or `hosts:` section layered on top of the base
+// config. Vars override and nodes are merged by ID like included files.
+type Overlay struct {
+	Profiles []string               `yaml:"profiles"` // Profiles a host turns on
+	Vars     map[string]interface{} `yaml:"vars"`
+	Scrpits  map[string]string      `yaml:"scripts"`
+	Pkgs     []Package              `yaml:"pkgs"`
+	Files    []File                 `yaml:"files"`
+	Tasks    []Task                 `yaml:"tasks"`
+}
+
+// NodeID returns the ID a package is known by.
+func (p *Package) NodeID() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Def
+}
+
+// NodeID returns the ID a file is known by; files without one are keyed
+// by destination.
+func (f *File) NodeID() string {
+	if f.ID != "" {
+		return f.ID
+	}
+	return f.Dest
+}
+
+func mergeOverlays(base, incoming map[string]*Overlay) map[string]*Overlay {
+	if len(incoming) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]*Overlay)
+	}
+	for name, o := range incoming {
+		if o == nil {
+			o = &Overlay{}
+		}
+		cur, ok := base[name]
+		if !ok {
+			base[name] = o
+			continue
+		}
+		cur.Profiles = append(cur.Profiles, o.Profiles...)
+		cur.Vars = mergeVars(cur.Vars, o.Vars)
+		cur.Scrpits = mergeStringMap(cur.Scrpits, o.Scrpits)
+		cur.Pkgs = append(cur.Pkgs, o.Pkgs...)
+		cur.Files = append(cur.Files, o.Files...)
+		cur.Tasks = append(cur.Tasks, o.Tasks...)
+	}
+	return base
+}
+
+func mergeStringMap(base, incoming map[string]string) map[string]string {
+	if len(incoming) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]string)
+	}
+	for k, v := range incoming {
+		base[k] = v
+	}
+	return base
+}
+
+// mergeVars overrides vars as a whole; lists and maps are not combined.
+func mergeVars(base, incoming map[string]interface{}) map[string]interface{} {
+	if len(incoming) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]interface{})
+	}
+	for k, v := range incoming {
+		base[k] = v
+	}
+	return base
+}
+
+// MatchHosts returns the `hosts:` keys matching hostname. Glob patterns come
+// before exact names so the most specific section is applied last.
+func (c *Config) MatchHosts(hostname string) []string {
+	var globs, exact []string
+	for pattern := range c.Hosts {
+		if pattern == hostname {
+			exact = append(exact, pattern)
+		} else if ok, _ := filepath.Match(pattern, hostname); ok {
+			globs = append(globs, pattern)
+		}
+	}
+	sort.Strings(globs)
+	return append(globs, exact...)
+}
+
+// ApplyOverlays layers the requested profiles and the host sections matching
+// hostname onto the config. Profiles named by a matching host are applied as
+// if requested. It returns the applied section names in order.
+func (c *Config) ApplyOverlays(profiles []string, hostname string) ([]string, error) {
+	hosts := c.MatchHosts(hostname)
+
+	var wanted []string
+	seen := make(map[string]bool)
+	addProfile := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			wanted = append(wanted, name)
+		}
+	}
+	for _, name := range profiles {
+		addProfile(name)
+	}
+	for _, h := range hosts {
+		for _, name := range c.Hosts[h].Profiles {
+			addProfile(name)
+		}
+	}
+
+	var applied []string
+	for _, name := range wanted {
+		o, ok := c.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile '%s' (available: %s)", name, strings.Join(c.ProfileNames(), ", "))
+		}
+		if err := c.apply("profile:"+name, o); err != nil {
+			return nil, fmt.Errorf("profile '%s': %w", name, err)
+		}
+		applied = append(applied, "profile:"+name)
+	}
+	for _, h := range hosts {
+		if err := c.apply("host:"+h, c.Hosts[h]); err != nil {
+			return nil, fmt.Errorf("host '%s': %w", h, err)
+		}
+		applied = append(applied, "host:"+h)
+	}
+	return applied, nil
+}
+
+// ProfileNames lists the declared profiles.
+func (c *Config) ProfileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Config) apply(name string, o *Overlay) error {
+	if o == nil {
+		return nil
+	}
+	c.Vars = mergeVars(c.Vars, o.Vars)
+	if len(o.Vars) > 0 {
+		c.VarSources = append(c.VarSources, VarSource{Name: name, Layer: vars.LayerOverlay, Vars: o.Vars})
+	}
+	c.Scrpits = mergeStringMap(c.Scrpits, o.Scrpits)
+
+	var err error
+	if c.Pkgs, err = mergePkgs(c.Pkgs, o.Pkgs, &c.Warnings); err != nil {
+		return err
+	}
+	if c.Files, err = mergeFiles(c.Files, o.Files, &c.Warnings); err != nil {
+		return err
+	}
+	c.Tasks, err = mergeTasks(c.Tasks, o.Tasks, &c.Warnings)
+	return err
+}
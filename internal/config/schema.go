@@ -3,22 +3,41 @@ package config
 import (
 	"os"
     "dotbuilder/internal/context"
+    "dotbuilder/internal/vars"
     "dotbuilder/pkg/constants"
 	"gopkg.in/yaml.v3"
 	"path/filepath"
 	"fmt"
-	"strings"
 	"sort"
+	"strconv"
 )
 
 type Config struct {
 	Include []string         	`yaml:"include"`
 	Meta  Meta              	`yaml:"meta"`
-	Vars  map[string]string 	`yaml:"vars"`
+	Vars  map[string]interface{} `yaml:"vars"` // Strings, numbers, bools, lists and maps
+	Secrets map[string]*Secret  `yaml:"secrets"`
 	Scrpits map[string]string   `yaml:"scripts"`
+	TemplatesDir string        `yaml:"templates_dir"` // Shared {{template}} snippets
 	Pkgs  []Package         	`yaml:"pkgs"`
 	Files []File            	`yaml:"files"`
 	Tasks []Task            	`yaml:"tasks"`
+
+	// Overlays, applied by ApplyOverlays
+	Profiles map[string]*Overlay `yaml:"profiles"`
+	Hosts    map[string]*Overlay `yaml:"hosts"`
+
+	Diagnostics []Diagnostic `yaml:"-"` // Problems found while loading
+	Warnings    []Diagnostic `yaml:"-"` // Likely mistakes that do not stop a run
+	VarSources  []VarSource  `yaml:"-"` // Vars per file and overlay, in load order
+}
+
+// VarSource is the vars one file or overlay declared, kept so precedence
+// and provenance can be worked out later.
+type VarSource struct {
+	Name  string // File path or "profile:name" / "host:name"
+	Layer string // vars.LayerConfig, vars.LayerInclude or vars.LayerOverlay
+	Vars  map[string]interface{}
 }
 
 type Meta struct {
@@ -30,10 +49,19 @@ type Package struct {
 	Name    string            `yaml:"name"`
 	Map     map[string]string `yaml:"map"`
 	Def     string            `yaml:"def"` // Default name
+	Version string            `yaml:"version"` // Exact ("1.2.3") or constraint (">=1.4")
+
+	// Per-map-entry versions, from `map: {apt: {name: x, version: y}}`
+	MapVersions map[string]string `yaml:"-"`
 	Manager string            `yaml:"manager"`
 	PM      string            `yaml:"pm"` // Alias for Manager
 	Ignore  bool              `yaml:"ignore"`
 	Deps    []string          `yaml:"deps"`
+	Tags    []string          `yaml:"tags"`
+	When    string            `yaml:"when"` // Condition on facts and vars
+	Merge   string            `yaml:"merge"` // replace|merge|remove an earlier definition
+	Origin  Origin            `yaml:"-"`
+	keys    map[string]bool   // Keys written in the config, see deepMerge
 
 	// Install Lifecycle
 	Check string `yaml:"check"`
@@ -45,6 +73,7 @@ type Package struct {
 	PmInstallTpl string `yaml:"pmi"`
 	PmCheckTpl   string `yaml:"pmc"`
 	PmUpdateTpl  string `yaml:"pmu"`
+	PmRemoveTpl  string `yaml:"pmr"`
 
 	// Maintenance
 	Upd   string `yaml:"upd"`
@@ -52,13 +81,16 @@ type Package struct {
 	Group string `yaml:"group"`
 }
 
-func mergeConfigs(base, incoming *Config) {
+func mergeConfigs(base, incoming *Config) error {
 	if incoming.Meta.Name != "" {
 		base.Meta.Name = incoming.Meta.Name
 	}
 	if incoming.Meta.Ver != "" {
 		base.Meta.Ver = incoming.Meta.Ver
 	}
+	if incoming.TemplatesDir != "" {
+		base.TemplatesDir = incoming.TemplatesDir
+	}
 
 	// Vars & Scripts: recursive merge
 	for k, v := range incoming.Vars {
@@ -67,23 +99,101 @@ func mergeConfigs(base, incoming *Config) {
 	for k, v := range incoming.Scrpits {
 		base.Scrpits[k] = v
 	}
+	for k, v := range incoming.Secrets {
+		if base.Secrets == nil {
+			base.Secrets = make(map[string]*Secret)
+		}
+		base.Secrets[k] = v
+	}
+
+	// Pkgs, Files, Tasks: merged by ID
+	var err error
+	if base.Pkgs, err = mergePkgs(base.Pkgs, incoming.Pkgs, &base.Warnings); err != nil {
+		return err
+	}
+	if base.Files, err = mergeFiles(base.Files, incoming.Files, &base.Warnings); err != nil {
+		return err
+	}
+	if base.Tasks, err = mergeTasks(base.Tasks, incoming.Tasks, &base.Warnings); err != nil {
+		return err
+	}
+
+	// Profiles & Hosts: merged by name
+	base.Profiles = mergeOverlays(base.Profiles, incoming.Profiles)
+	base.Hosts = mergeOverlays(base.Hosts, incoming.Hosts)
 
-	// Pkgs, Files, Tasks: append
-	base.Pkgs = append(base.Pkgs, incoming.Pkgs...)
-	base.Files = append(base.Files, incoming.Files...)
-	base.Tasks = append(base.Tasks, incoming.Tasks...)
+	base.Diagnostics = append(base.Diagnostics, incoming.Diagnostics...)
+	base.Warnings = append(base.Warnings, incoming.Warnings...)
+	base.VarSources = append(base.VarSources, incoming.VarSources...)
+	return nil
 }
 
-// UnmarshalYAML supports polymorphic parse: "- git" or "- name: git"
+// UnmarshalYAML supports polymorphic parse: "- git" or "- name: git".
+// Map values may be a name or a mapping with name and version.
 func (p *Package) UnmarshalYAML(value *yaml.Node) error {
 	if value.Kind == yaml.ScalarNode {
 		p.Name = value.Value
 		p.Def = value.Value
 		return nil
 	}
+
+	node, versions, err := splitMapVersions(value)
+	if err != nil {
+		return err
+	}
+
 	// Fallback to default struct unmarshal
 	type plain Package
-	return value.Decode((*plain)(p))
+	if err := node.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		p.MapVersions = versions
+	}
+	return nil
+}
+
+// splitMapVersions rewrites `map` entries of the form {name, version} into
+// plain names on a copy of the node and returns the versions by map key.
+func splitMapVersions(value *yaml.Node) (*yaml.Node, map[string]string, error) {
+	if value.Kind != yaml.MappingNode {
+		return value, nil, nil
+	}
+
+	copied := *value
+	copied.Content = append([]*yaml.Node{}, value.Content...)
+	versions := make(map[string]string)
+
+	for i := 0; i+1 < len(copied.Content); i += 2 {
+		if copied.Content[i].Value != "map" || copied.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+		m := *copied.Content[i+1]
+		m.Content = append([]*yaml.Node{}, m.Content...)
+
+		for j := 0; j+1 < len(m.Content); j += 2 {
+			entry := m.Content[j+1]
+			if entry.Kind != yaml.MappingNode {
+				continue
+			}
+			var spec struct {
+				Name    string `yaml:"name"`
+				Version string `yaml:"version"`
+			}
+			if err := entry.Decode(&spec); err != nil {
+				return nil, nil, err
+			}
+			if spec.Name == "" {
+				return nil, nil, fmt.Errorf("line %d: map entry '%s' needs a name", entry.Line, m.Content[j].Value)
+			}
+			if spec.Version != "" {
+				versions[m.Content[j].Value] = spec.Version
+			}
+			m.Content[j+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: spec.Name, Line: entry.Line, Column: entry.Column}
+		}
+		copied.Content[i+1] = &m
+	}
+	return &copied, versions, nil
 }
 
 func (p *Package) GetManager() string {
@@ -114,6 +224,21 @@ func (p *Package) ResolveName(sys *context.SystemInfo) string {
     return realName
 }
 
+// ResolveVersion returns the version requested for the system: a version on
+// the matching map entry wins over the package version.
+func (p *Package) ResolveVersion(sys *context.SystemInfo) string {
+    lookupKeys := constants.GetPkgLookupKeys(sys.Distro, sys.BasePM)
+    for _, key := range lookupKeys {
+        if _, ok := p.Map[key]; ok {
+            if v, ok := p.MapVersions[key]; ok {
+                return v
+            }
+            break
+        }
+    }
+    return p.Version
+}
+
 type File struct {
     ID          string      `yaml:"id"`
 	Src         string 	    `yaml:"src"`
@@ -122,19 +247,92 @@ type File struct {
     Check       string      `yaml:"check"`
     Append      bool        `yaml:"append"`
     OverrideIf  string      `yaml:"override_if"`
-	Tpl         bool   	    `yaml:"tpl"`
+	Tpl         bool   	    `yaml:"tpl"` // Shorthand for mode: template
+	Mode        string      `yaml:"mode"` // link (default), copy, template or hardlink
+	Perm        string      `yaml:"perm"` // Octal permissions of copies and templates, e.g. "0600"
 	Deps        []string	`yaml:"deps"`
 	Group 		string 		`yaml:"group"`
+	Tags        []string	`yaml:"tags"`
+	When        string      `yaml:"when"`
+	Merge       string      `yaml:"merge"`
+	Backup      BackupSpec  `yaml:"backup"`
+	Origin      Origin      `yaml:"-"`
+	keys        map[string]bool // Keys written in the config, see deepMerge
+}
+
+// File modes: how the source is put at the destination.
+const (
+	FileLink     = "link"     // Symlink to the source
+	FileCopy     = "copy"     // Copy of the source
+	FileTemplate = "template" // Rendered source
+	FileHardlink = "hardlink" // Hard link to the source
+)
+
+// ResolveMode returns the mode of a file entry; `tpl: true` means template.
+func (f *File) ResolveMode() string {
+	if f.Mode != "" {
+		return f.Mode
+	}
+	if f.Tpl {
+		return FileTemplate
+	}
+	return FileLink
+}
+
+// ParsePerm parses `perm`. ok is false when it is not set.
+func (f *File) ParsePerm() (perm os.FileMode, ok bool, err error) {
+	if f.Perm == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(f.Perm, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, false, fmt.Errorf("invalid perm '%s' (octal, e.g. 0600)", f.Perm)
+	}
+	return os.FileMode(n), true, nil
+}
+
+// BackupSpec is `backup: true|false|<dir>`. Backups are on by default and go
+// to the state directory unless a directory is given.
+type BackupSpec struct {
+	Disabled bool
+	Dir      string
+}
+
+func (b *BackupSpec) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: backup must be true, false or a directory", value.Line)
+	}
+	var on bool
+	if err := value.Decode(&on); err == nil {
+		b.Disabled = !on
+		return nil
+	}
+	b.Dir = value.Value
+	return nil
+}
+
+// Secret is a variable read only when a template references it, from an
+// age (.age) or GPG (.gpg, .asc) encrypted file or from a command's output.
+type Secret struct {
+	Cmd      string `yaml:"cmd"`      // e.g. "pass show github/token"
+	File     string `yaml:"file"`     // Relative to the declaring config file
+	Identity string `yaml:"identity"` // age identity file, default ~/.config/age/keys.txt
+	Origin   Origin `yaml:"-"`
 }
 
 type Task struct {
 	ID    string            `yaml:"id"`
 	Deps  []string          `yaml:"deps"`
-	Vars  map[string]string `yaml:"vars"`
+	Vars  map[string]interface{} `yaml:"vars"`
 	Check string            `yaml:"check"`
 	On    map[string]string `yaml:"on"`
 	Run   string            `yaml:"run"`
 	Group string 			`yaml:"group"`
+	Tags  []string          `yaml:"tags"`
+	When  string            `yaml:"when"`
+	Merge string            `yaml:"merge"`
+	Origin Origin           `yaml:"-"`
+	keys   map[string]bool  // Keys written in the config, see deepMerge
 }
 
 func loadRecursive(path string, visited map[string]bool) (*Config, error) {
@@ -149,20 +347,39 @@ func loadRecursive(path string, visited map[string]bool) (*Config, error) {
 		return nil, err
 	}
 
-	var currentCfg Config
-	if err := yaml.Unmarshal(data, &currentCfg); err != nil {
+	root, err := decoderFor(path)(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
 	}
 
+	var currentCfg Config
+	if root.Kind != 0 {
+		if err := root.Decode(&currentCfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		currentCfg.Diagnostics = checkFile(root, &currentCfg, path)
+	}
+	if len(currentCfg.Vars) > 0 {
+		currentCfg.VarSources = []VarSource{{Name: path, Layer: vars.LayerInclude, Vars: currentCfg.Vars}}
+	}
+
 	if currentCfg.Vars == nil {
-		currentCfg.Vars = make(map[string]string)
+		currentCfg.Vars = make(map[string]interface{})
+	}
+	for _, sec := range currentCfg.Secrets {
+		if sec != nil && sec.File != "" && !filepath.IsAbs(sec.File) {
+			sec.File = filepath.Join(filepath.Dir(path), sec.File)
+		}
+	}
+	if currentCfg.TemplatesDir != "" && !filepath.IsAbs(currentCfg.TemplatesDir) {
+		currentCfg.TemplatesDir = filepath.Join(filepath.Dir(path), currentCfg.TemplatesDir)
 	}
 	if currentCfg.Scrpits == nil {
 		currentCfg.Scrpits = make(map[string]string)
 	}
 	
 	finalConfig := &Config{
-		Vars:    make(map[string]string),
+		Vars:    make(map[string]interface{}),
 		Scrpits: make(map[string]string),
 	}
 	
@@ -175,7 +392,7 @@ func loadRecursive(path string, visited map[string]bool) (*Config, error) {
 			return nil, fmt.Errorf("include path not found: %s (referenced in %s)", includePath, path)
 		}
 
-		// If the include path is a directory, process all .yml/.yaml files within it.
+		// If the include path is a directory, process all config files within it.
 		if info.IsDir() {
 			entries, err := os.ReadDir(absIncludePath)
 			if err != nil {
@@ -185,7 +402,7 @@ func loadRecursive(path string, visited map[string]bool) (*Config, error) {
 			var filesToInclude []string
 			for _, entry := range entries {
 				name := entry.Name()
-				if !entry.IsDir() && (strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml")) {
+				if !entry.IsDir() && isConfigFile(name) {
 					filesToInclude = append(filesToInclude, filepath.Join(absIncludePath, name))
 				}
 			}
@@ -197,17 +414,23 @@ func loadRecursive(path string, visited map[string]bool) (*Config, error) {
 				if err != nil {
 					return nil, err // Propagate error
 				}
-				mergeConfigs(finalConfig, includedCfg)
+				if err := mergeConfigs(finalConfig, includedCfg); err != nil {
+					return nil, fmt.Errorf("%s: %w", filePath, err)
+				}
 			}
 		} else { // Otherwise, it's a single file.
 			includedCfg, err := loadRecursive(absIncludePath, visited)
 			if err != nil {
 				return nil, err
 			}
-			mergeConfigs(finalConfig, includedCfg)
+			if err := mergeConfigs(finalConfig, includedCfg); err != nil {
+				return nil, fmt.Errorf("%s: %w", absIncludePath, err)
+			}
 		}
 	}
-	mergeConfigs(finalConfig, &currentCfg)
+	if err := mergeConfigs(finalConfig, &currentCfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 	return finalConfig, nil
 }
 
@@ -216,5 +439,14 @@ func Load(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return loadRecursive(absPath, make(map[string]bool))
+	cfg, err := loadRecursive(absPath, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.VarSources {
+		if cfg.VarSources[i].Name == absPath {
+			cfg.VarSources[i].Layer = vars.LayerConfig
+		}
+	}
+	return cfg, nil
 }
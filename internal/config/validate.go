@@ -0,0 +1,422 @@
+package config
+
+import (
+	"dotbuilder/pkg/constants"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Origin is where a node was declared.
+type Origin struct {
+	File string
+	Line int
+}
+
+func (o Origin) String() string {
+	if o.File == "" {
+		return "<unknown>"
+	}
+	if o.Line == 0 {
+		return o.File // Formats without positions, such as TOML
+	}
+	return fmt.Sprintf("%s:%d", o.File, o.Line)
+}
+
+// Diagnostic is a config problem found before anything runs.
+type Diagnostic struct {
+	Origin
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Origin, d.Message)
+}
+
+// checkFile reports unknown keys and IDs declared twice in one file, and
+// records where every node of the file was declared.
+func checkFile(root *yaml.Node, cfg *Config, file string) []Diagnostic {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	var diags []Diagnostic
+	checkKeys(root, reflect.TypeOf(Config{}), file, &diags)
+
+	setOrigins(root, file, cfg.Pkgs, cfg.Files, cfg.Tasks)
+	secretsNode := mappingValue(root, "secrets")
+	for name, sec := range cfg.Secrets {
+		if sec == nil {
+			continue
+		}
+		sec.Origin = Origin{File: file}
+		if n := mappingValue(secretsNode, name); n != nil {
+			sec.Origin.Line = n.Line
+		}
+	}
+	diags = append(diags, fileDuplicates(file, cfg.Pkgs, cfg.Files, cfg.Tasks)...)
+
+	for _, section := range []struct {
+		key      string
+		overlays map[string]*Overlay
+	}{{"profiles", cfg.Profiles}, {"hosts", cfg.Hosts}} {
+		sectionNode := mappingValue(root, section.key)
+		for name, o := range section.overlays {
+			if o == nil {
+				continue
+			}
+			if n := mappingValue(sectionNode, name); n != nil {
+				setOrigins(n, file, o.Pkgs, o.Files, o.Tasks)
+			}
+			diags = append(diags, fileDuplicates(file, o.Pkgs, o.Files, o.Tasks)...)
+		}
+	}
+	return diags
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setOrigins(n *yaml.Node, file string, pkgs []Package, files []File, tasks []Task) {
+	seqItem := func(key string, i int) *yaml.Node {
+		seq := mappingValue(n, key)
+		if seq == nil || seq.Kind != yaml.SequenceNode || i >= len(seq.Content) {
+			return nil
+		}
+		return seq.Content[i]
+	}
+	for i := range pkgs {
+		item := seqItem("pkgs", i)
+		pkgs[i].Origin = Origin{File: file, Line: nodeLine(item)}
+		pkgs[i].keys = mappingKeys(item)
+	}
+	for i := range files {
+		item := seqItem("files", i)
+		files[i].Origin = Origin{File: file, Line: nodeLine(item)}
+		files[i].keys = mappingKeys(item)
+	}
+	for i := range tasks {
+		item := seqItem("tasks", i)
+		tasks[i].Origin = Origin{File: file, Line: nodeLine(item)}
+		tasks[i].keys = mappingKeys(item)
+	}
+}
+
+func nodeLine(n *yaml.Node) int {
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
+
+// mappingKeys returns the keys of a mapping node, nil for anything else.
+func mappingKeys(n *yaml.Node) map[string]bool {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keys[n.Content[i].Value] = true
+	}
+	return keys
+}
+
+// fileDuplicates reports IDs defined twice in the same list of one file.
+// Redefinitions across files are merged on purpose.
+func fileDuplicates(file string, pkgs []Package, files []File, tasks []Task) []Diagnostic {
+	var diags []Diagnostic
+	check := func(kind string, ids []string, origins []Origin) {
+		seen := make(map[string]Origin)
+		for i, id := range ids {
+			if id == "" {
+				continue
+			}
+			if first, ok := seen[id]; ok {
+				diags = append(diags, Diagnostic{origins[i], fmt.Sprintf("duplicate %s ID '%s' (first defined at line %d)", kind, id, first.Line)})
+				continue
+			}
+			seen[id] = origins[i]
+		}
+	}
+
+	var ids []string
+	var origins []Origin
+	for i := range pkgs {
+		ids, origins = append(ids, pkgs[i].NodeID()), append(origins, pkgs[i].Origin)
+	}
+	check("package", ids, origins)
+
+	ids, origins = nil, nil
+	for i := range files {
+		ids, origins = append(ids, files[i].NodeID()), append(origins, files[i].Origin)
+	}
+	check("file", ids, origins)
+
+	ids, origins = nil, nil
+	for i := range tasks {
+		ids, origins = append(ids, tasks[i].ID), append(origins, tasks[i].Origin)
+	}
+	check("task", ids, origins)
+	return diags
+}
+
+// checkKeys walks a YAML node against the yaml tags of t and reports keys
+// that do not map to any field.
+func checkKeys(n *yaml.Node, t reflect.Type, file string, diags *[]Diagnostic) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return // Scalar shorthands such as "- git"
+		}
+		fields := yamlFields(t)
+		if len(fields) == 0 {
+			return // Decodes itself, e.g. BackupSpec
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				msg := fmt.Sprintf("unknown key '%s'", key.Value)
+				if s := suggest(key.Value, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean '%s'?)", s)
+				}
+				*diags = append(*diags, Diagnostic{Origin{file, key.Line}, msg})
+				continue
+			}
+			checkKeys(n.Content[i+1], ft, file, diags)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range n.Content {
+			checkKeys(item, t.Elem(), file, diags)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			checkKeys(n.Content[i+1], t.Elem(), file, diags)
+		}
+	}
+}
+
+// yamlFields maps the yaml keys of a struct to their field types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fields[tag] = f.Type
+	}
+	return fields
+}
+
+// suggest returns the known key closest to an unknown one, if any is close.
+// Ties go to a key with the same first letter.
+func suggest(key string, fields map[string]reflect.Type) string {
+	best, bestDist := "", 3
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := editDistance(key, name)
+		if d < bestDist || (d == bestDist && best != "" && best[0] != key[0] && name[0] == key[0]) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance counting a swap of two adjacent
+// characters as one edit.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min(vals ...int) int {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// checkFileMode reports unknown modes and options the mode cannot honour.
+func checkFileMode(f *File, id string) []Diagnostic {
+	var diags []Diagnostic
+	report := func(format string, args ...interface{}) {
+		diags = append(diags, Diagnostic{f.Origin, fmt.Sprintf("file [%s]: ", id) + fmt.Sprintf(format, args...)})
+	}
+
+	switch f.Mode {
+	case "", FileLink, FileCopy, FileTemplate, FileHardlink:
+	default:
+		report("unknown mode '%s' (link, copy, template or hardlink)", f.Mode)
+		return diags
+	}
+	mode := f.ResolveMode()
+	if f.Tpl && mode != FileTemplate {
+		report("'tpl: true' conflicts with mode '%s'", mode)
+	}
+	if f.Append && f.Mode != "" && mode != FileCopy && mode != FileTemplate {
+		report("'append' needs mode copy or template, not '%s'", mode)
+	}
+	if _, _, err := f.ParsePerm(); err != nil {
+		report("%v", err)
+	} else if f.Perm != "" && (mode == FileLink || mode == FileHardlink) && !f.Append {
+		report("'perm' only applies to copy and template modes")
+	}
+	return diags
+}
+
+func secOrigin(sec *Secret) Origin {
+	if sec == nil {
+		return Origin{}
+	}
+	return sec.Origin
+}
+
+// Validate checks the merged config: problems found while loading, mutually
+// exclusive fields, dangling deps, IDs shared between kinds and unknown
+// package managers.
+func (c *Config) Validate() []Diagnostic {
+	diags := append([]Diagnostic{}, c.Diagnostics...)
+
+	ids := make(map[string]Origin)
+	kinds := make(map[string]string)
+	addID := func(kind, id string, o Origin) {
+		if prev, ok := kinds[id]; ok {
+			diags = append(diags, Diagnostic{o, fmt.Sprintf("%s ID '%s' is already used by a %s at %s", kind, id, prev, ids[id])})
+			return
+		}
+		ids[id], kinds[id] = o, kind
+	}
+
+	for i := range c.Files {
+		f := &c.Files[i]
+		id := f.NodeID()
+		if id == "" {
+			id = "file_" + strconv.Itoa(i)
+		}
+		addID("file", id, f.Origin)
+		if f.Override && f.Append {
+			diags = append(diags, Diagnostic{f.Origin, fmt.Sprintf("file [%s]: 'override' and 'append' cannot be both true", id)})
+		}
+		diags = append(diags, checkFileMode(f, id)...)
+	}
+	for i := range c.Pkgs {
+		addID("package", c.Pkgs[i].NodeID(), c.Pkgs[i].Origin)
+	}
+	for i := range c.Tasks {
+		if c.Tasks[i].ID == "" {
+			diags = append(diags, Diagnostic{c.Tasks[i].Origin, "task without 'id'"})
+			continue
+		}
+		addID("task", c.Tasks[i].ID, c.Tasks[i].Origin)
+	}
+
+	checkDeps := func(kind, id string, deps []string, o Origin) {
+		for _, dep := range deps {
+			if _, ok := ids[dep]; !ok {
+				diags = append(diags, Diagnostic{o, fmt.Sprintf("%s [%s] depends on unknown node '%s'", kind, id, dep)})
+			}
+		}
+	}
+	for i := range c.Files {
+		checkDeps("file", c.Files[i].NodeID(), c.Files[i].Deps, c.Files[i].Origin)
+	}
+	for i := range c.Pkgs {
+		checkDeps("package", c.Pkgs[i].NodeID(), c.Pkgs[i].Deps, c.Pkgs[i].Origin)
+	}
+	for i := range c.Tasks {
+		checkDeps("task", c.Tasks[i].ID, c.Tasks[i].Deps, c.Tasks[i].Origin)
+	}
+
+	custom := make(map[string]bool)
+	for i := range c.Pkgs {
+		if c.Pkgs[i].PmInstallTpl != "" {
+			custom[c.Pkgs[i].Name] = true
+		}
+	}
+	for i := range c.Pkgs {
+		p := &c.Pkgs[i]
+		if p.PM != "" && p.Manager != "" && p.PM != p.Manager {
+			diags = append(diags, Diagnostic{p.Origin, fmt.Sprintf("package [%s]: 'pm' and 'manager' are aliases and cannot differ", p.NodeID())})
+		}
+		for _, pm := range strings.Split(p.GetManager(), ";") {
+			pm = strings.TrimSpace(pm)
+			if pm != "" && !custom[pm] && !constants.IsKnownPM(pm) {
+				diags = append(diags, Diagnostic{p.Origin, fmt.Sprintf("package [%s]: unknown manager '%s'", p.NodeID(), pm)})
+			}
+		}
+	}
+
+	for name, sec := range c.Secrets {
+		switch {
+		case sec == nil || (sec.Cmd == "") == (sec.File == ""):
+			diags = append(diags, Diagnostic{secOrigin(sec), fmt.Sprintf("secret '%s': set exactly one of 'cmd' and 'file'", name)})
+		case sec.Identity != "" && sec.File == "":
+			diags = append(diags, Diagnostic{sec.Origin, fmt.Sprintf("secret '%s': 'identity' needs an age 'file'", name)})
+		}
+		if _, ok := c.Vars[name]; ok {
+			diags = append(diags, Diagnostic{secOrigin(sec), fmt.Sprintf("secret '%s' is also defined in vars", name)})
+		}
+	}
+
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Line < diags[j].Line
+	})
+	return diags
+}
@@ -16,6 +16,7 @@ type SystemInfo struct {
     User   string // e.g., chi
     Home   string // e.g., home/chi
 	Arch   string // e.g., "amd64", "arm64"
+	Hostname string // e.g., "laptop"
 }
 
 func Detect() *SystemInfo {
@@ -23,6 +24,7 @@ func Detect() *SystemInfo {
 		OS: "linux",
 		Arch: runtime.GOARCH,
 	}
+	info.Hostname, _ = os.Hostname()
 
     u, err := user.Current()
 	if err == nil {
@@ -58,6 +58,62 @@ func (g *Graph) Sort(items []string) ([]string, error) {
 	return result, nil
 }
 
+// Ancestors returns the items plus everything they transitively depend on.
+func (g *Graph) Ancestors(items []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+
+	var visit func(string)
+	visit = func(n string) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		result = append(result, n)
+		for _, dep := range g.Nodes[n] {
+			visit(dep)
+		}
+	}
+
+	for _, item := range items {
+		visit(item)
+	}
+	return result
+}
+
+// Descendants returns everything that transitively depends on the items,
+// excluding the items themselves.
+func (g *Graph) Descendants(items []string) []string {
+	children := make(map[string][]string)
+	for child, parents := range g.Nodes {
+		for _, p := range parents {
+			children[p] = append(children[p], child)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, item := range items {
+		seen[item] = true
+	}
+
+	var result []string
+	queue := append([]string{}, items...)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		next := children[n]
+		sort.Strings(next)
+		for _, c := range next {
+			if !seen[c] {
+				seen[c] = true
+				result = append(result, c)
+				queue = append(queue, c)
+			}
+		}
+	}
+	return result
+}
+
 func (g *Graph) SortLayers(items []string) ([][]string, error) {
 	adj := make(map[string][]string)
 	inDegree := make(map[string]int)
@@ -16,4 +16,19 @@ func NewSkipError(format string, a ...interface{}) error {
 	}
 }
 
-var ErrSkipped = &SkipError{Reason: "skipped"}
\ No newline at end of file
+var ErrSkipped = &SkipError{Reason: "skipped"}
+
+// UpgradedError marks an already installed package that was upgraded.
+type UpgradedError struct {
+	Reason string
+}
+
+func (e *UpgradedError) Error() string {
+	return e.Reason
+}
+
+func NewUpgradedError(format string, a ...interface{}) error {
+	return &UpgradedError{
+		Reason: fmt.Sprintf(format, a...),
+	}
+}
\ No newline at end of file
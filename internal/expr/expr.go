@@ -0,0 +1,337 @@
+// Package expr evaluates the boolean `when:` conditions of config nodes.
+//
+// Grammar:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | primary
+//	primary = "(" expr ")" | value [ ( "==" | "!=" | "=~" ) value ]
+//	value   = string | number | ident | "vars." ident | "true" | "false"
+//
+// A value used on its own is true unless it is empty, "0" or "false".
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Env supplies the values of identifiers. Facts are the bare identifiers
+// (sys_os, hostname, ...); unknown facts are an error so typos surface.
+// Vars back "vars.name" and default to the empty string.
+type Env struct {
+	Facts map[string]string
+	Vars  map[string]string
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokString
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at column %d", i+1)
+			}
+			toks = append(toks, token{tokString, sb.String(), i})
+			i = j + 1
+		case strings.HasPrefix(src[i:], "&&"), strings.HasPrefix(src[i:], "||"),
+			strings.HasPrefix(src[i:], "=="), strings.HasPrefix(src[i:], "!="),
+			strings.HasPrefix(src[i:], "=~"):
+			toks = append(toks, token{tokOp, src[i : i+2], i})
+			i += 2
+		case c == '!':
+			toks = append(toks, token{tokOp, "!", i})
+			i++
+		case isIdentRune(rune(c)):
+			j := i
+			for j < len(src) && (isIdentRune(rune(src[j])) || src[j] == '.' || src[j] == '-') {
+				j++
+			}
+			toks = append(toks, token{tokIdent, src[i:j], i})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at column %d", c, i+1)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// node is a parsed expression.
+type node interface {
+	eval(env *Env) (string, error)
+}
+
+type literal string
+
+type ident string
+
+type unaryNot struct{ x node }
+
+type binary struct {
+	op   string
+	l, r node
+}
+
+func (n literal) eval(*Env) (string, error) { return string(n), nil }
+
+func (n ident) eval(env *Env) (string, error) {
+	name := string(n)
+	switch name {
+	case "true", "false":
+		return name, nil
+	}
+	if strings.HasPrefix(name, "vars.") {
+		return env.Vars[strings.TrimPrefix(name, "vars.")], nil
+	}
+	v, ok := env.Facts[name]
+	if !ok {
+		return "", fmt.Errorf("unknown identifier '%s' (use vars.%s for variables)", name, name)
+	}
+	return v, nil
+}
+
+func (n unaryNot) eval(env *Env) (string, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return "", err
+	}
+	return fromBool(!truthy(v)), nil
+}
+
+func (n binary) eval(env *Env) (string, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return "", err
+	}
+
+	// Short-circuit so the right side may reference missing facts safely.
+	switch n.op {
+	case "&&":
+		if !truthy(l) {
+			return "false", nil
+		}
+	case "||":
+		if truthy(l) {
+			return "true", nil
+		}
+	}
+
+	r, err := n.r.eval(env)
+	if err != nil {
+		return "", err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return fromBool(truthy(r)), nil
+	case "==":
+		return fromBool(l == r), nil
+	case "!=":
+		return fromBool(l != r), nil
+	case "=~":
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return "", fmt.Errorf("invalid regexp '%s': %w", r, err)
+		}
+		return fromBool(re.MatchString(l)), nil
+	}
+	return "", fmt.Errorf("unknown operator '%s'", n.op)
+}
+
+func truthy(v string) bool {
+	return v != "" && v != "0" && v != "false"
+}
+
+func fromBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().val == "||" {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{"||", l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().val == "&&" {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{"&&", l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.kind == tokOp && t.val == "!" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNot{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.peek().kind == tokLParen {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, fmt.Errorf("expected ')' at column %d", t.pos+1)
+		}
+		return x, nil
+	}
+
+	l, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokOp && (t.val == "==" || t.val == "!=" || t.val == "=~") {
+		p.next()
+		r, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return binary{t.val, l, r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) parseValue() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literal(t.val), nil
+	case tokIdent:
+		if strings.IndexFunc(t.val, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' }) < 0 {
+			return literal(t.val), nil
+		}
+		return ident(t.val), nil
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected '%s' at column %d", t.val, t.pos+1)
+}
+
+// Expr is a parsed condition.
+type Expr struct {
+	root node
+}
+
+// Parse compiles a condition.
+func Parse(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected '%s' at column %d", t.val, t.pos+1)
+	}
+	return &Expr{root: root}, nil
+}
+
+// Eval evaluates the condition against env.
+func (e *Expr) Eval(env *Env) (bool, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+// Eval parses and evaluates a condition in one step.
+func Eval(src string, env *Env) (bool, error) {
+	e, err := Parse(src)
+	if err != nil {
+		return false, fmt.Errorf("when '%s': %w", src, err)
+	}
+	ok, err := e.Eval(env)
+	if err != nil {
+		return false, fmt.Errorf("when '%s': %w", src, err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,151 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+var testEnv = &Env{
+	Facts: map[string]string{
+		"sys_os":     "linux",
+		"sys_distro": "debian",
+		"sys_arch":   "amd64",
+		"hostname":   "work-laptop",
+		"empty":      "",
+	},
+	Vars: map[string]string{
+		"desktop": "true",
+		"server":  "false",
+		"zero":    "0",
+		"count":   "3",
+		"name":    `it's "x"`,
+	},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		// Values on their own
+		{"true", true},
+		{"false", false},
+		{"vars.desktop", true},
+		{"vars.server", false},
+		{"vars.zero", false},
+		{"vars.missing", false},
+		{"empty", false},
+		{"sys_os", true},
+		{`""`, false},
+		{`"x"`, true},
+		{"0", false},
+		{"1", true},
+
+		// Strings
+		{`sys_os == "linux"`, true},
+		{`sys_os == 'linux'`, true},
+		{`sys_os != "linux"`, false},
+		{`sys_os == "darwin"`, false},
+		{`"linux" == sys_os`, true},
+		{`vars.name == "it's \"x\""`, true},
+		{`hostname =~ "^work-"`, true},
+		{`hostname =~ "^home-"`, false},
+		{`sys_distro =~ "deb|ubuntu"`, true},
+		{`vars.missing == ""`, true},
+
+		// Numbers compare as written
+		{"vars.count == 3", true},
+		{"vars.count != 3", false},
+		{`vars.count == "3"`, true},
+		{"vars.count == 3.0", false},
+		{"1.10 == 1.10", true},
+
+		// Operators
+		{"!false", true},
+		{"!!true", true},
+		{"!vars.server", true},
+		{`!sys_os == "linux"`, false}, // ! applies to the whole comparison
+		{`!(sys_os == "linux")`, false},
+		{"true && false", false},
+		{"true && true", true},
+		{"false || true", true},
+		{"false || false", false},
+
+		// Precedence: && before ||, left to right
+		{"true || false && false", true},
+		{"false && true || true", true},
+		{"(true || false) && false", false},
+		{"false && (true || true)", false},
+		{`sys_os == "linux" && sys_arch == "amd64" || vars.server`, true},
+		{`sys_os == "darwin" || sys_arch == "arm64" && vars.desktop`, false},
+		{`!(sys_os == "darwin" || vars.server) && vars.desktop`, true},
+
+		// Short-circuit skips unknown identifiers on the right
+		{"false && nope", false},
+		{"true || nope", true},
+	}
+	for _, tt := range tests {
+		got, err := Eval(tt.src, testEnv)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// Unknown identifiers
+		{"os == \"linux\"", "unknown identifier 'os'"},
+		{"desktop", "use vars.desktop"},
+		{"true && nope", "unknown identifier 'nope'"},
+		{"!nope", "unknown identifier 'nope'"},
+
+		// Parse errors
+		{"", "unexpected end of expression"},
+		{`sys_os == `, "unexpected end of expression"},
+		{`sys_os == "linux`, "unterminated string at column 11"},
+		{"(true", "expected ')' at column 6"},
+		{"true)", "unexpected ')' at column 5"},
+		{"true false", "unexpected 'false' at column 6"},
+		{"sys_os = 1", "unexpected '=' at column 8"},
+		{"a & b", "unexpected '&' at column 3"},
+		{"&& true", "unexpected '&&' at column 1"},
+		{`sys_os == "a" == "b"`, "unexpected '==' at column 15"},
+
+		// Evaluation errors
+		{`hostname =~ "("`, "invalid regexp"},
+	}
+	for _, tt := range tests {
+		_, err := Eval(tt.src, testEnv)
+		if err == nil {
+			t.Errorf("%s: no error, want %q", tt.src, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q does not mention %q", tt.src, err, tt.want)
+		}
+		if !strings.HasPrefix(err.Error(), "when '"+tt.src+"': ") {
+			t.Errorf("%s: error %q does not name the condition", tt.src, err)
+		}
+	}
+}
+
+func TestParseOnce(t *testing.T) {
+	e, err := Parse(`sys_os == vars.os`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for os, want := range map[string]bool{"linux": true, "darwin": false} {
+		env := &Env{Facts: testEnv.Facts, Vars: map[string]string{"os": os}}
+		if got, err := e.Eval(env); err != nil || got != want {
+			t.Errorf("vars.os=%s: got %v, %v; want %v", os, got, err, want)
+		}
+	}
+}
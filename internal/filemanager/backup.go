@@ -0,0 +1,152 @@
+package filemanager
+
+import (
+	"dotbuilder/internal/config"
+	"dotbuilder/internal/state"
+	"dotbuilder/pkg/logger"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backup moves or copies existing targets aside before they are removed or
+// overwritten. Backups of a run live in <dir>/<run id>/<original path>.
+type Backup struct {
+	Dir   string // Default root, overridden per file by `backup: <dir>`
+	RunID string
+
+	mu      sync.Mutex
+	Records []state.Backup
+}
+
+func NewBackup(dir, runID string) *Backup {
+	return &Backup{Dir: dir, RunID: runID}
+}
+
+// DefaultBackupDir is where backups go unless a file sets its own directory.
+func DefaultBackupDir() string {
+	return filepath.Join(state.Dir(), "backups")
+}
+
+// Save backs up dest. With move the original is renamed away (the caller is
+// about to remove it), otherwise it is copied (the caller rewrites it in
+// place). A nil Backup or `backup: false` makes this a no-op.
+func (b *Backup) Save(fs FileSystem, id string, spec config.BackupSpec, dest string, move bool) error {
+	if b == nil || spec.Disabled {
+		return nil
+	}
+
+	root := b.Dir
+	if spec.Dir != "" {
+		home, _ := os.UserHomeDir()
+		root = expandPath(spec.Dir, home)
+	}
+	target := filepath.Join(root, b.RunID, dest)
+
+	if err := fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if move {
+		if err := moveFile(fs, dest, target); err != nil {
+			return err
+		}
+	} else {
+		info, err := fs.Stat(dest)
+		if err != nil {
+			return err
+		}
+		data, err := fs.ReadFile(dest)
+		if err != nil {
+			return err
+		}
+		if err := fs.WriteFile(target, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	logger.InfoFile("  Backed up %s -> %s", dest, target)
+
+	b.mu.Lock()
+	b.Records = append(b.Records, state.Backup{
+		RunID:     b.RunID,
+		ID:        id,
+		Dest:      dest,
+		Path:      target,
+		Timestamp: time.Now(),
+	})
+	b.mu.Unlock()
+	return nil
+}
+
+// Drain returns the backups taken so far and clears them, so each record
+// is persisted once.
+func (b *Backup) Drain() []state.Backup {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recs := b.Records
+	b.Records = nil
+	return recs
+}
+
+// Restore puts a backup back in place. Whatever currently occupies the
+// destination is itself backed up first.
+func (b *Backup) Restore(fs FileSystem, rec state.Backup) error {
+	if _, err := fs.Lstat(rec.Dest); err == nil {
+		if err := b.Save(fs, rec.ID, config.BackupSpec{}, rec.Dest, true); err != nil {
+			return err
+		}
+	}
+	if err := fs.MkdirAll(filepath.Dir(rec.Dest), 0755); err != nil {
+		return err
+	}
+	if err := moveFile(fs, rec.Path, rec.Dest); err != nil {
+		return err
+	}
+	logger.InfoFile("Restored %s from %s", rec.Dest, rec.Path)
+	return nil
+}
+
+// moveFile renames src to dst, or copies and removes it when they are on
+// different filesystems. Links are recreated rather than followed.
+func moveFile(fs FileSystem, src, dst string) error {
+	err := fs.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	info, err := fs.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := fs.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := fs.Symlink(target, dst); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		data, err := fs.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := fs.WriteFile(dst, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := fs.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot move %s across filesystems: not a file or link", src)
+	}
+	return fs.Remove(src)
+}
@@ -16,6 +16,9 @@ type FileSystem interface {
 	Readlink(name string) (string, error)
 	WriteFile(name string, data []byte, perm os.FileMode) error
 	Stat(name string) (fs.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
 }
 
 // RealFS 真实文件系统
@@ -29,6 +32,9 @@ func (RealFS) Lstat(name string) (fs.FileInfo, error)       { return os.Lstat(na
 func (RealFS) Readlink(name string) (string, error)         { return os.Readlink(name) }
 func (RealFS) WriteFile(n string, d []byte, p os.FileMode) error { return os.WriteFile(n, d, p) }
 func (RealFS) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (RealFS) Rename(old, new string) error                 { return os.Rename(old, new) }
+func (RealFS) Link(old, new string) error                   { return os.Link(old, new) }
+func (RealFS) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
 
 // DryRunFS 模拟文件系统
 type DryRunFS struct{}
@@ -70,4 +76,16 @@ func (DryRunFS) WriteFile(n string, d []byte, p os.FileMode) error {
 }
 func (DryRunFS) Stat(name string) (fs.FileInfo, error) {
 	return os.Stat(name)
-}
\ No newline at end of file
+}
+func (DryRunFS) Rename(old, new string) error {
+	logger.InfoFile("[DryRun] Move %s -> %s", old, new)
+	return nil
+}
+func (DryRunFS) Link(old, new string) error {
+	logger.InfoFile("[DryRun] Hardlink %s -> %s", new, old)
+	return nil
+}
+func (DryRunFS) Chmod(name string, mode os.FileMode) error {
+	logger.InfoFile("[DryRun] Chmod %s %04o", name, mode)
+	return nil
+}
@@ -0,0 +1,100 @@
+package filemanager
+
+import (
+	"bytes"
+	"dotbuilder/internal/config"
+	"os"
+)
+
+type FileState int
+
+const (
+	FileMissing FileState = iota // Destination does not exist
+	FileInSync                   // Destination matches the desired state
+	FileDiffers                  // Destination exists but differs
+)
+
+func (s FileState) String() string {
+	switch s {
+	case FileInSync:
+		return "IN_SYNC"
+	case FileDiffers:
+		return "DIFFERS"
+	default:
+		return "MISSING"
+	}
+}
+
+type FileStatus struct {
+	Src   string
+	Dest  string
+	State FileState
+}
+
+// Inspect compares the destination of a file entry with what
+// ProcessSingleFile would produce, without touching the filesystem.
+func Inspect(f config.File, vars map[string]interface{}, baseDir string) (*FileStatus, error) {
+	fs := RealFS{}
+	src, dest, err := ResolvePaths(f, vars, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	st := &FileStatus{Src: src, Dest: dest, State: FileMissing}
+
+	destInfo, err := fs.Lstat(dest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+
+	mode := f.ResolveMode()
+	isLink := destInfo.Mode()&os.ModeSymlink != 0
+	if mode == config.FileLink && isLink {
+		if target, _ := fs.Readlink(dest); target == src {
+			st.State = FileInSync
+			return st, nil
+		}
+	}
+	if mode == config.FileHardlink && !f.Append {
+		if sameFile(fs, src, destInfo) {
+			st.State = FileInSync
+		} else {
+			st.State = FileDiffers
+		}
+		return st, nil
+	}
+
+	var srcContent []byte
+	if mode == config.FileTemplate {
+		srcContent, err = renderContent(src, vars, fs)
+	} else {
+		srcContent, err = fs.ReadFile(src)
+	}
+	if err != nil {
+		return st, err
+	}
+
+	destContent, err := fs.ReadFile(dest)
+	if err != nil {
+		st.State = FileDiffers
+		return st, nil
+	}
+
+	writes := mode == config.FileCopy || mode == config.FileTemplate
+	switch {
+	case f.Append && bytes.Contains(destContent, srcContent):
+		st.State = FileInSync
+	case writes && !isLink && bytes.Equal(destContent, srcContent):
+		st.State = FileInSync
+		if perm, enforce, _ := targetPerm(f, mode, src, fs); enforce && destInfo.Mode().Perm() != perm {
+			st.State = FileDiffers
+		}
+	case mode == config.FileLink && f.Override && bytes.Equal(destContent, srcContent):
+		st.State = FileInSync
+	default:
+		st.State = FileDiffers
+	}
+	return st, nil
+}
@@ -3,37 +3,32 @@ package filemanager
 import (
 	"bytes"
 	"dotbuilder/internal/config"
+	"dotbuilder/internal/tmpl"
     "dotbuilder/pkg/shell"
 	"dotbuilder/pkg/logger"
 	"os"
     "os/exec"
 	"path/filepath"
 	"strings"
-	"text/template"
 	"dotbuilder/internal/errors"
 )
 
-// Helper to render path strings
-func renderPathString(tplStr string, vars map[string]string) string {
+// Helper to render path strings; name is the field, for errors
+func renderPathString(name, tplStr string, vars map[string]interface{}) (string, error) {
 	data := map[string]interface{}{"vars": vars}
-	tmpl, err := template.New("path").Parse(tplStr)
-	if err != nil {
-		return tplStr
-	}
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return tplStr
-	}
-	return buf.String()
+	return tmpl.Render(name, tplStr, data)
 }
 
-func runCheckCommand(cmdStr string, vars map[string]string) bool {
-    finalCmd := renderPathString(cmdStr, vars)
+func runCheckCommand(cmdStr string, vars map[string]interface{}) (bool, error) {
+	finalCmd, err := tmpl.RenderCmd("override_if", cmdStr, map[string]interface{}{"vars": vars})
+	if err != nil {
+		return false, err
+	}
 	cmd := exec.Command("sh", "-c", finalCmd)
-	return cmd.Run() == nil // Exit Code 0 means true
+	return cmd.Run() == nil, nil // Exit Code 0 means true
 }
 
-func ProcessFiles(files []config.File, vars map[string]string, runner *shell.Runner, baseDir string) {
+func ProcessFiles(files []config.File, vars map[string]interface{}, runner *shell.Runner, baseDir string) {
 	logger.Info("=== Start processing file links ===")
 
 	var fs FileSystem
@@ -44,14 +39,19 @@ func ProcessFiles(files []config.File, vars map[string]string, runner *shell.Run
 	}
 
 	for _, f := range files {
-		ProcessSingleFile(f, vars, fs, baseDir, runner)
+		ProcessSingleFile(f, vars, fs, baseDir, runner, nil)
 	}
 }
 
 
-func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, baseDir string, runner *shell.Runner) error {
+// ProcessSingleFile links, renders or appends one file entry. Existing
+// targets are handed to bk before they are removed or rewritten.
+func ProcessSingleFile(f config.File, vars map[string]interface{}, fs FileSystem, baseDir string, runner *shell.Runner, bk *Backup) error {
 	if f.Check != "" {
-		renderedCheck := renderPathString(f.Check, vars)
+		renderedCheck, err := tmpl.RenderCmd("check", f.Check, map[string]interface{}{"vars": vars})
+		if err != nil {
+			return err
+		}
 		if runner.ExecSilent(renderedCheck) == 0 {
 			logger.Success("  File Check passed for dest '%s' (Skipped).", f.Dest)
 			return errors.NewSkipError("Check passed")
@@ -64,30 +64,29 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 		return nil
 	}
 
-	home, _ := os.UserHomeDir()
-	rawSrc := renderPathString(f.Src, vars)
-	rawDest := renderPathString(f.Dest, vars)
-
-	src := expandPath(rawSrc, home)
-	dest := expandPath(rawDest, home)
-
-	if !filepath.IsAbs(src) && !strings.HasPrefix(src, "~") {
-		src = filepath.Join(baseDir, src)
+	src, dest, err := ResolvePaths(f, vars, baseDir)
+	if err != nil {
+		return err
 	}
 
 	logger.InfoFile("%s -> %s", dest, src)
 
+	mode := f.ResolveMode()
 	var srcContent []byte
-	var err error
 
-	if f.Tpl {
+	if mode == config.FileTemplate {
 		srcContent, err = renderContent(src, vars, fs)
 	} else {
 		srcContent, err = fs.ReadFile(src)
 	}
 
 	if err != nil {
-		logger.Error("  Failed to read/render source: %v", err)
+		logger.Fail("  Failed to read/render source: %v", err)
+		return err
+	}
+
+	perm, enforcePerm, err := targetPerm(f, mode, src, fs)
+	if err != nil {
 		return err
 	}
 
@@ -98,17 +97,32 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 	destExists := err == nil
 
 	if destExists {
-		if !f.Tpl && destInfo.Mode()&os.ModeSymlink != 0 {
+		isLink := destInfo.Mode()&os.ModeSymlink != 0
+		if mode == config.FileLink && isLink {
 			target, _ := fs.Readlink(dest)
 			if target == src {
 				logger.Success("  Already linked correctly.")
 				return errors.NewSkipError("Already linked")
 			}
 		}
+		if mode == config.FileHardlink && sameFile(fs, src, destInfo) {
+			logger.Success("  Already hard-linked.")
+			return errors.NewSkipError("Already linked")
+		}
 
-		if f.Tpl || f.Override {
+		// A link to the source reads the same but is not a copy.
+		writes := mode == config.FileCopy || mode == config.FileTemplate
+		if (writes && !isLink) || (mode == config.FileLink && f.Override) {
 			destContent, errRead := fs.ReadFile(dest)
 			if errRead == nil && bytes.Equal(destContent, srcContent) {
+				if writes && enforcePerm && destInfo.Mode().Perm() != perm {
+					if err := fs.Chmod(dest, perm); err != nil {
+						logger.Warn("  Chmod failed: %v", err)
+						return err
+					}
+					logger.Success("  Content identical, permissions set to %04o.", perm)
+					return nil
+				}
 				logger.Success("  Content identical (Skipped).")
 				return errors.NewSkipError("Content identical")
 			}
@@ -118,7 +132,7 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 	if f.Append {
 		if !destExists {
 			logger.InfoFile("Creating new file (Append): %s", dest)
-			if err := fs.WriteFile(dest, srcContent, 0644); err != nil {
+			if err := writeFile(fs, dest, srcContent, perm, enforcePerm); err != nil {
 				logger.Error("  Write failed: %v", err)
 				return err
 			}
@@ -137,6 +151,11 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 			return errors.NewSkipError("Content exists")
 		}
 
+		if err := bk.Save(fs, f.ID, f.Backup, dest, false); err != nil {
+			logger.Warn("  Backup failed, keeping target: %v", err)
+			return err
+		}
+
 		logger.InfoFile("Appending content to: %s", dest)
 		if len(destContent) > 0 && destContent[len(destContent)-1] != '\n' {
 			destContent = append(destContent, '\n')
@@ -159,7 +178,11 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 				logger.Info("  [DryRun] Check command: %s -> assume true", f.OverrideIf)
 				shouldOverride = true
 			} else {
-				if runCheckCommand(f.OverrideIf, vars) {
+				passed, err := runCheckCommand(f.OverrideIf, vars)
+				if err != nil {
+					return err
+				}
+				if passed {
 					logger.Info("  Check passed, proceeding to override.")
 					shouldOverride = true
 				} else {
@@ -173,17 +196,35 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 			return errors.NewSkipError("Target exists")
 		}
 
-		logger.InfoFile("Removing existing target: %s", dest)
-		fs.Remove(dest)
+		if !f.Backup.Disabled && bk != nil {
+			if err := bk.Save(fs, f.ID, f.Backup, dest, true); err != nil {
+				logger.Warn("  Backup failed, keeping target: %v", err)
+				return err
+			}
+		} else {
+			logger.InfoFile("Removing existing target: %s", dest)
+			fs.Remove(dest)
+		}
 	}
 
-	if f.Tpl {
-		if err := fs.WriteFile(dest, srcContent, 0644); err != nil {
+	switch mode {
+	case config.FileTemplate, config.FileCopy:
+		if err := writeFile(fs, dest, srcContent, perm, enforcePerm); err != nil {
 			logger.Error("  Write failed: %v", err)
 			return err
 		}
-		logger.Success("  Template rendered and written.")
-	} else {
+		if mode == config.FileCopy {
+			logger.Success("  Copied.")
+		} else {
+			logger.Success("  Template rendered and written.")
+		}
+	case config.FileHardlink:
+		if err := fs.Link(src, dest); err != nil {
+			logger.Warn("  Hard link failed: %v", err)
+			return err
+		}
+		logger.Success("  Hard-linked.")
+	default:
 		if err := fs.Symlink(src, dest); err != nil {
 			logger.Warn("  Link failed: %v", err)
 			return err
@@ -194,21 +235,73 @@ func ProcessSingleFile(f config.File, vars map[string]string, fs FileSystem, bas
 	return nil
 }
 
-func renderContent(src string, data map[string]string, fs FileSystem) ([]byte, error) {
+// ResolvePaths renders and expands the source and destination of a file
+// entry; relative sources are taken relative to baseDir.
+func ResolvePaths(f config.File, vars map[string]interface{}, baseDir string) (string, string, error) {
+	home, _ := os.UserHomeDir()
+	rawSrc, err := renderPathString("src", f.Src, vars)
+	if err != nil {
+		return "", "", err
+	}
+	rawDest, err := renderPathString("dest", f.Dest, vars)
+	if err != nil {
+		return "", "", err
+	}
+
+	src := expandPath(rawSrc, home)
+	dest := expandPath(rawDest, home)
+
+	if !filepath.IsAbs(src) && !strings.HasPrefix(src, "~") {
+		src = filepath.Join(baseDir, src)
+	}
+	return src, dest, nil
+}
+
+// targetPerm returns the permissions of a written destination: `perm` when
+// set, the source's for copies and 0644 otherwise. enforce is false when
+// the default may be narrowed by the umask or kept on an existing file.
+func targetPerm(f config.File, mode, src string, fs FileSystem) (perm os.FileMode, enforce bool, err error) {
+	if perm, ok, err := f.ParsePerm(); err != nil || ok {
+		return perm, ok, err
+	}
+	if mode == config.FileCopy {
+		// A source still to be generated (dry run) has no mode yet
+		if info, err := fs.Stat(src); err == nil {
+			return info.Mode().Perm(), true, nil
+		}
+	}
+	return 0644, false, nil
+}
+
+// writeFile writes data and, when enforced, sets perm exactly instead of
+// leaving it to the umask.
+func writeFile(fs FileSystem, name string, data []byte, perm os.FileMode, enforce bool) error {
+	if err := fs.WriteFile(name, data, perm); err != nil {
+		return err
+	}
+	if enforce {
+		return fs.Chmod(name, perm)
+	}
+	return nil
+}
+
+// sameFile reports whether dest is a hard link to src.
+func sameFile(fs FileSystem, src string, destInfo os.FileInfo) bool {
+	srcInfo, err := fs.Stat(src)
+	return err == nil && os.SameFile(srcInfo, destInfo)
+}
+
+func renderContent(src string, data map[string]interface{}, fs FileSystem) ([]byte, error) {
 	b, err := fs.ReadFile(src)
 	if err != nil {
 		return nil, err
 	}
 	tplData := map[string]interface{}{"vars": data}
-	tmpl, err := template.New("file").Parse(string(b))
+	s, err := tmpl.RenderFile(src, string(b), tplData)
 	if err != nil {
 		return nil, err
 	}
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, tplData); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return []byte(s), nil
 }
 
 func expandPath(path, home string) string {
@@ -0,0 +1,74 @@
+package filemanager
+
+import (
+	"dotbuilder/internal/config"
+	"dotbuilder/internal/state"
+	"dotbuilder/pkg/logger"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isWithin reports whether path lies inside dir.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// PruneOrphan removes the destination of a file that is no longer declared.
+// Links are only removed while they still point into baseDir, regular files
+// only while their content matches the recorded hash. It returns true when
+// the entry can be forgotten (removed or already gone). Removed files are
+// handed to bk first.
+func PruneOrphan(e *state.Entry, fs FileSystem, baseDir string, bk *Backup) (bool, error) {
+	if e.Dest == "" || !e.Managed {
+		return true, nil
+	}
+
+	info, err := fs.Lstat(e.Dest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Debug("  [%s] %s already gone.", e.ID, e.Dest)
+			return true, nil
+		}
+		return false, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := fs.Readlink(e.Dest)
+		if err != nil {
+			return false, err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(e.Dest), target)
+		}
+		if !isWithin(target, baseDir) {
+			return false, fmt.Errorf("link points outside the dotfiles dir (%s), leaving it", target)
+		}
+	} else {
+		if e.Mode == "append" {
+			// The rest of the file is not ours; only the entry goes.
+			logger.Warn("  [%s] Content appended to %s is left in place; remove it by hand if unwanted.", e.ID, e.Dest)
+			return true, nil
+		}
+		if e.Hash == "" || state.HashFile(e.Dest) != e.Hash {
+			return false, fmt.Errorf("content changed since it was written, leaving it")
+		}
+	}
+
+	logger.InfoFile("Pruning %s", e.Dest)
+	if bk != nil {
+		if err := bk.Save(fs, e.ID, config.BackupSpec{}, e.Dest, true); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := fs.Remove(e.Dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,95 @@
+package lockfile
+
+import (
+	"dotbuilder/internal/context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the lockfile written next to the config file.
+const FileName = "dotbuilder.lock"
+
+const fileVersion = 1
+
+// Package records the versions installed for one declared package. Versions
+// are keyed by the resolved name, since a package may map to several.
+type Package struct {
+	Manager  string            `yaml:"manager"`
+	Versions map[string]string `yaml:"versions"`
+}
+
+// Platform holds the locked packages of one distro/PM combination.
+type Platform struct {
+	Generated string              `yaml:"generated"`
+	Packages  map[string]*Package `yaml:"packages"`
+}
+
+type Lock struct {
+	Version   int                  `yaml:"version"`
+	Platforms map[string]*Platform `yaml:"platforms"`
+
+	path string
+}
+
+// PathFor returns the lockfile path for a config file.
+func PathFor(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), FileName)
+}
+
+// Key identifies the platform section for a machine, e.g. "arch/pacman".
+func Key(sys *context.SystemInfo) string {
+	return fmt.Sprintf("%s/%s", sys.Distro, sys.BasePM)
+}
+
+// Load reads a lockfile; a missing file yields an empty lock.
+func Load(path string) (*Lock, error) {
+	l := &Lock{
+		Version:   fileVersion,
+		Platforms: make(map[string]*Platform),
+		path:      path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if l.Platforms == nil {
+		l.Platforms = make(map[string]*Platform)
+	}
+	l.path = path
+	return l, nil
+}
+
+// Set replaces the section for a platform.
+func (l *Lock) Set(key string, pkgs map[string]*Package) {
+	l.Platforms[key] = &Platform{
+		Generated: time.Now().Format(time.RFC3339),
+		Packages:  pkgs,
+	}
+}
+
+// Save writes the lockfile atomically.
+func (l *Lock) Save() error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	header := []byte("# Generated by 'dotbuilder lock'. Do not edit.\n")
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, append(header, data...), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
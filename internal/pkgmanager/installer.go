@@ -3,6 +3,8 @@ package pkgmanager
 import (
 	"dotbuilder/internal/config"
 	"dotbuilder/internal/context"
+	"dotbuilder/internal/lockfile"
+	"dotbuilder/internal/tmpl"
 	"dotbuilder/pkg/constants"
 	"dotbuilder/pkg/logger"
 	"dotbuilder/pkg/shell"
@@ -15,17 +17,20 @@ import (
 // Engine
 type Engine struct {
 	Sys           *context.SystemInfo
-	Vars          map[string]string
+	Vars          map[string]interface{}
 	RegisteredPMs map[string]*config.Package
 	Runner        *shell.Runner
 	IsRoot        bool
 	mu            sync.Mutex
 	UpdatedPMs    map[string]bool
 	pmLocks       sync.Map
+	Upgrade       bool // Upgrade packages whose check passes
+	NoInstall     bool // Leave missing packages alone (upgrade-only runs)
+	Locked        *lockfile.Platform // Install exactly these versions (apply --locked)
 }
 
 // NewEngine
-func NewEngine(sys *context.SystemInfo, vars map[string]string, isRoot bool, dryRun bool) *Engine {
+func NewEngine(sys *context.SystemInfo, vars map[string]interface{}, isRoot bool, dryRun bool) *Engine {
 	return &Engine{
 		Sys:           sys,
 		Vars:          vars,
@@ -59,7 +64,11 @@ func (e *Engine) EnsurePMUpdated(pmName string) {
 	e.UpdatedPMs[pmName] = true
 	e.mu.Unlock()
 
-	cmd := e.BuildSystemUpdateCmd(pmName)
+	cmd, err := e.BuildSystemUpdateCmd(pmName)
+	if err != nil {
+		logger.Warn("Failed to update PM %s: %v", pmName, err)
+		return
+	}
 	if cmd == "" {
 		return 
 	}
@@ -88,6 +97,11 @@ func (e *Engine) GetBatchManager(p *config.Package) string {
 		return ""
 	}
 
+	// Pinned packages need their own check and install syntax.
+	if e.pinned(p) {
+		return ""
+	}
+
 	mgr := p.GetManager()
 
 	if mgr == "" || mgr == e.Sys.BasePM {
@@ -113,17 +127,46 @@ func (e *Engine) InstallBatch(pmName string, names []string) error {
 		return nil
 	}
 
-	var toInstall []string
+	var toInstall, installed []string
 	for _, name := range names {
-		checkCmd := e.BuildCheckCmd(pmName, name)
+		checkCmd, err := e.BuildCheckCmd(pmName, name)
+		if err != nil {
+			return err
+		}
 		if checkCmd != "" && e.Runner.ExecSilent(checkCmd) == 0 {
 			logger.Debug("[%s] Check passed for '%s'", pmName, name)
+			installed = append(installed, name)
 			continue
 		}
 		toInstall = append(toInstall, name)
 	}
 
+	if e.NoInstall {
+		toInstall = nil
+	}
+
+	var upgradeErr error
+	if e.Upgrade && len(installed) > 0 {
+		cmd, err := e.BuildBatchUpgradeCmd(pmName, installed)
+		if err != nil {
+			return err
+		}
+		if cmd != "" {
+			before, known := e.installedVersions(pmName, installed)
+			upgradeErr = e.upgradeBatch(pmName, installed, cmd)
+			if upgradeErr == nil {
+				upgradeErr = e.upgradeResult(pmName, installed, before, known)
+			}
+		}
+	}
+
 	if len(toInstall) == 0 {
+		if upgradeErr != nil {
+			return upgradeErr
+		}
+		if len(installed) == 0 {
+			return errors.NewSkipError("Not installed")
+		}
 		logger.InfoPkg("[%s] Batch items already installed.", pmName)
 		return errors.NewSkipError("All installed")
 	}
@@ -134,35 +177,35 @@ func (e *Engine) InstallBatch(pmName string, names []string) error {
 	defer unlock()
 
 	logger.InfoPkg("[%s] Batch installing: %v", pmName, names)
-	cmd := e.BuildBatchInstallCmd(pmName, toInstall)
-	return e.Runner.ExecStream(cmd, fmt.Sprintf("%s-batch", pmName))
+	cmd, err := e.BuildBatchInstallCmd(pmName, toInstall)
+	if err != nil {
+		return err
+	}
+	if err := e.Runner.ExecStream(cmd, fmt.Sprintf("%s-batch", pmName)); err != nil {
+		return err
+	}
+	return upgradeErr
 }
 
 
 func (e *Engine) InstallOne(p *config.Package) error {
-	managerStr := p.GetManager()
+	managerStr := e.managerList(p)
 	if managerStr == "" {
-		if p.Exec != "" {
-			managerStr = "non-pm"
-		} else if e.Sys.BasePM != "" && e.Sys.BasePM != "unknown" {
-			managerStr = e.Sys.BasePM
-		} else {
-			logger.Warn("No manager specified for package '%s' and system BasePM is unknown.", p.Name)
-			return fmt.Errorf("no manager specified for package '%s'", p.Name)
-		}
+		logger.Warn("No manager specified for package '%s' and system BasePM is unknown.", p.Name)
+		return fmt.Errorf("no manager specified for package '%s'", p.Name)
 	}
 
 	managers := strings.Split(managerStr, ";")
 
-	tplData := map[string]interface{}{
-		"vars": e.Vars,
-		"name": p.Name,
-		"os":   e.Sys.OS,
-	}
+	tplData := e.pkgTplData(p)
 
-	if p.Pre != "" {
+	if p.Pre != "" && !e.NoInstall {
 		logger.Debug("Running Pre-Hook for %s", p.Name)
-		if err := e.Runner.ExecStream(RenderCmd(p.Pre, tplData), p.Name); err != nil {
+		cmd, err := RenderCmd("pre", p.Pre, tplData)
+		if err == nil {
+			err = e.Runner.ExecStream(cmd, p.Name)
+		}
+		if err != nil {
 			logger.Warn("[%s] Pre-hook failed: %v", p.Name, err)
 			return err
 		}
@@ -171,6 +214,7 @@ func (e *Engine) InstallOne(p *config.Package) error {
 	var lastErr error
 	installSuccess := false
 	alreadyInstalled := false
+	installedPM := ""
 
 	for _, pm := range managers {
 		pm = strings.TrimSpace(pm)
@@ -181,6 +225,7 @@ func (e *Engine) InstallOne(p *config.Package) error {
 		if err == nil {
 			if skipped {
 				alreadyInstalled = true
+				installedPM = pm
 			} else {
 				installSuccess = true
 			}
@@ -192,10 +237,18 @@ func (e *Engine) InstallOne(p *config.Package) error {
 	}
 
 	if alreadyInstalled {
+		if e.Upgrade {
+			return e.upgradeOne(p, installedPM, tplData)
+		}
 		logger.Success("[%s] Already installed (Checked).", p.Name)
 		return errors.NewSkipError("Already installed")
 	}
 
+	if lastErr == errNotInstalled {
+		logger.Info("[%s] Not installed, leaving it.", p.Name)
+		return errors.NewSkipError("Not installed")
+	}
+
 	if !installSuccess {
 		if p.Ignore {
 			logger.Warn("Failed to install '%s', ignoring (ignore=true).", p.Name)
@@ -210,7 +263,11 @@ func (e *Engine) InstallOne(p *config.Package) error {
 
 	if p.Post != "" {
 		logger.Debug("Running Post-Hook for %s", p.Name)
-		if err := e.Runner.ExecStream(RenderCmd(p.Post, tplData), p.Name); err != nil {
+		cmd, err := RenderCmd("post", p.Post, tplData)
+		if err == nil {
+			err = e.Runner.ExecStream(cmd, p.Name)
+		}
+		if err != nil {
 			logger.Warn("[%s] Post-hook failed: %v", p.Name, err)
 			return err
 		}
@@ -221,10 +278,7 @@ func (e *Engine) InstallOne(p *config.Package) error {
 
 
 func (e *Engine) tryInstallCore(p *config.Package, pm string, tplData map[string]interface{}) (bool, error) {
-	realPM := pm
-	if realPM == "apt" && e.Sys.BasePM == "apt-get" {
-		realPM = "apt-get"
-	}
+	realPM := e.realPM(pm)
 
 	targetPM := realPM
 	if targetPM == "" {
@@ -236,38 +290,19 @@ func (e *Engine) tryInstallCore(p *config.Package, pm string, tplData map[string
 		displayPM = "System"
 	}
 
-	nameForPM := p.ResolveName(e.Sys)
-	systemCheckCmd := e.BuildCheckCmd(targetPM, nameForPM)
-	if systemCheckCmd == "" {
-		systemCheckCmd = "false"
+	isInstalled, err := e.checkInstalled(p, targetPM, tplData)
+	if err != nil {
+		return false, err
 	}
 
-	isInstalled := false
-
-    checkTplData := make(map[string]interface{})
-    for k, v := range tplData {
-        checkTplData[k] = v
-    }
-
-	if p.Check != "" {
-        checkTplData["super"] = map[string]interface{}{
-			"check": systemCheckCmd,
-		}
-		
-		userCheckCmd := RenderCmd(p.Check, checkTplData)
-		if e.Runner.ExecSilent(userCheckCmd) == 0 {
-			isInstalled = true
-		}
-    } else {
-        if systemCheckCmd != "false" && e.Runner.ExecSilent(systemCheckCmd) == 0 {
-			isInstalled = true
-		}
-    }
-
 	if isInstalled {
 		return true, nil // Skipped, No Error
 	}
 
+	if e.NoInstall {
+		return false, errNotInstalled
+	}
+
 	logger.InfoPkg("Installing %s (%s)...", p.Name, displayPM)
 
     if pm != "none" {
@@ -282,23 +317,37 @@ func (e *Engine) tryInstallCore(p *config.Package, pm string, tplData map[string
 	var installCmd string
 
 	if p.Exec != "" {
-		installCmd = RenderCmd(p.Exec, tplData)
+		installCmd, err = RenderCmd("exec", p.Exec, tplData)
 	} else if pmDef, ok := e.RegisteredPMs[realPM]; ok {
-		installCmd = RenderCmd(pmDef.PmInstallTpl, tplData)
+		installCmd, err = RenderCmd("pmi", pmDef.PmInstallTpl, tplData)
 	} else {
 		_, installTpl, _ := constants.GetPMTemplates(realPM)
 
 		if installTpl != "" {
-			installCmd = RenderCmd(installTpl, tplData)
+			pinnedData := make(map[string]interface{})
+			for k, v := range tplData {
+				pinnedData[k] = v
+			}
+			if pinnedData["name"], err = e.pinNames(p, realPM, p.Name); err != nil {
+				return false, err
+			}
+			installCmd, err = RenderCmd("install", installTpl, pinnedData)
 		} else {
 		    if realPM == "" || realPM == e.Sys.BasePM {
-                nameForInstall := p.ResolveName(e.Sys)
-				installCmd = e.BuildInstallCmd(e.Sys.BasePM, nameForInstall)
+                var nameForInstall tmpl.Raw
+                nameForInstall, err = e.pinNames(p, e.Sys.BasePM, p.ResolveName(e.Sys))
+				if err != nil {
+					return false, err
+				}
+				installCmd, err = e.BuildInstallCmd(e.Sys.BasePM, nameForInstall)
 			} else {
 				return false, fmt.Errorf("unknown PM: %s", realPM)
 			}
         }
 	}
+	if err != nil {
+		return false, err
+	}
 
 	if err := e.Runner.ExecStream(installCmd, p.Name); err != nil {
 		return false, err
@@ -306,3 +355,142 @@ func (e *Engine) tryInstallCore(p *config.Package, pm string, tplData map[string
 
 	return false, nil // Not skipped (Installed), No Error
 }
+
+// checkInstalled runs the user check (with the PM check exposed as
+// {{.super.check}}) or, without one, the PM check for the resolved name.
+func (e *Engine) checkInstalled(p *config.Package, targetPM string, tplData map[string]interface{}) (bool, error) {
+	nameForPM := p.ResolveName(e.Sys)
+	systemCheckCmd, err := e.BuildCheckCmd(targetPM, nameForPM)
+	if err != nil {
+		return false, err
+	}
+	if systemCheckCmd == "" {
+		systemCheckCmd = "false"
+	}
+
+	if p.Check != "" {
+		userCheckCmd, err := RenderCmd("check", p.Check, superTplData(tplData, systemCheckCmd))
+		if err != nil {
+			return false, err
+		}
+		return e.Runner.ExecSilent(userCheckCmd) == 0, nil
+	}
+
+	if e.pinned(p) {
+		if ok, handled := e.checkVersion(p, targetPM, nameForPM); handled {
+			return ok, nil
+		}
+	}
+
+	return systemCheckCmd != "false" && e.Runner.ExecSilent(systemCheckCmd) == 0, nil
+}
+
+// superTplData adds the PM check to tplData as {{.super.check}}. It is a
+// command of its own, inserted as is rather than quoted as one word.
+func superTplData(tplData map[string]interface{}, systemCheckCmd string) map[string]interface{} {
+	data := make(map[string]interface{}, len(tplData)+1)
+	for k, v := range tplData {
+		data[k] = v
+	}
+	data["super"] = map[string]interface{}{
+		"check": tmpl.Raw(systemCheckCmd),
+	}
+	return data
+}
+
+// checkVersion verifies the installed version of every name against its
+// spec. handled is false when the PM cannot report versions.
+func (e *Engine) checkVersion(p *config.Package, pm, rawNames string) (ok bool, handled bool) {
+	names := strings.Fields(rawNames)
+	if len(names) == 0 {
+		return false, true
+	}
+	for _, name := range names {
+		installed, supported := e.InstalledVersion(pm, name)
+		if !supported {
+			logger.Debug("[%s] PM '%s' cannot report versions, checking presence only.", name, pm)
+			return false, false
+		}
+		if installed == "" {
+			return false, true
+		}
+		spec, locked := e.versionFor(p, name)
+		if spec == "" {
+			continue
+		}
+		if !VersionSatisfies(installed, spec) {
+			if locked {
+				logger.Warn("[%s] Drifted from lockfile: installed %s, locked %s.", name, installed, spec)
+			} else {
+				logger.InfoPkg("[%s] Installed version %s does not satisfy '%s'.", name, installed, spec)
+			}
+			return false, true
+		}
+		logger.Debug("[%s] Installed version %s satisfies '%s'", name, installed, spec)
+	}
+	return true, true
+}
+
+// pkgTplData is the template data for a package's own commands.
+func (e *Engine) pkgTplData(p *config.Package) map[string]interface{} {
+	return map[string]interface{}{
+		"vars":    e.Vars,
+		"name":    tmpl.ShellArgs(p.Name),
+		"os":      e.Sys.OS,
+		"version": e.templateVersion(p),
+	}
+}
+
+// IsInstalled reports whether the package check passes for any of its
+// managers, without installing anything. The second value is the manager
+// whose check passed; an error means a check template failed to render.
+func (e *Engine) IsInstalled(p *config.Package) (bool, string, error) {
+	tplData := e.pkgTplData(p)
+
+	for _, pm := range strings.Split(e.managerList(p), ";") {
+		pm = strings.TrimSpace(pm)
+		if pm == "" {
+			continue
+		}
+		targetPM := e.realPM(pm)
+		if targetPM == "" {
+			targetPM = e.Sys.BasePM
+		}
+		ok, err := e.checkInstalled(p, targetPM, tplData)
+		if err != nil {
+			return false, "", err
+		}
+		if ok {
+			return true, targetPM, nil
+		}
+	}
+	return false, "", nil
+}
+
+// ManagerFor returns the manager(s) a package would be installed with.
+func (e *Engine) ManagerFor(p *config.Package) string {
+	return e.managerList(p)
+}
+
+// managerList returns the raw ";"-separated manager string for a package,
+// falling back to "non-pm" for exec-only packages and to the system PM.
+func (e *Engine) managerList(p *config.Package) string {
+	managerStr := p.GetManager()
+	if managerStr != "" {
+		return managerStr
+	}
+	if p.Exec != "" {
+		return "non-pm"
+	}
+	if e.Sys.BasePM != "" && e.Sys.BasePM != "unknown" {
+		return e.Sys.BasePM
+	}
+	return ""
+}
+
+func (e *Engine) realPM(pm string) string {
+	if pm == "apt" && e.Sys.BasePM == "apt-get" {
+		return "apt-get"
+	}
+	return pm
+}
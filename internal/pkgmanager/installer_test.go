@@ -0,0 +1,27 @@
+package pkgmanager
+
+import (
+	"dotbuilder/internal/tmpl"
+	"testing"
+)
+
+func TestSuperCheckRendersAsCommand(t *testing.T) {
+	data := superTplData(map[string]interface{}{"name": tmpl.ShellArgs("git")}, "dpkg -s git >/dev/null 2>&1")
+	tests := []struct {
+		check string
+		want  string
+	}{
+		{"{{.super.check}}", "dpkg -s git >/dev/null 2>&1"},
+		{"{{.super.check}} && command -v {{.name}}", "dpkg -s git >/dev/null 2>&1 && command -v git"},
+		{"sh -c '{{.super.check}}'", "sh -c 'dpkg -s git >/dev/null 2>&1'"},
+	}
+	for _, tt := range tests {
+		got, err := RenderCmd("check", tt.check, data)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.check, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q rendered as %q, want %q", tt.check, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pkgmanager
+
+import (
+	"dotbuilder/internal/config"
+	"dotbuilder/internal/lockfile"
+	"dotbuilder/internal/tmpl"
+	"fmt"
+	"strings"
+)
+
+// lockedPackage returns the lockfile entry for a package in --locked mode.
+func (e *Engine) lockedPackage(p *config.Package) *lockfile.Package {
+	if e.Locked == nil {
+		return nil
+	}
+	return e.Locked.Packages[p.Name]
+}
+
+// versionFor returns the version spec for one resolved name: the locked
+// version in --locked mode, otherwise the configured one.
+func (e *Engine) versionFor(p *config.Package, name string) (spec string, locked bool) {
+	if lp := e.lockedPackage(p); lp != nil {
+		if v, ok := lp.Versions[name]; ok {
+			return v, true
+		}
+	}
+	return p.ResolveVersion(e.Sys), false
+}
+
+// templateVersion is the {{.version}} of a package's own templates.
+func (e *Engine) templateVersion(p *config.Package) string {
+	spec, _ := e.versionFor(p, strings.TrimSpace(p.ResolveName(e.Sys)))
+	return spec
+}
+
+// pinned reports whether a package needs version-aware check and install.
+func (e *Engine) pinned(p *config.Package) bool {
+	return p.ResolveVersion(e.Sys) != "" || e.lockedPackage(p) != nil
+}
+
+// pinNames pins every name of a space-separated list to its version and
+// returns them as shell arguments.
+func (e *Engine) pinNames(p *config.Package, pm, rawNames string) (tmpl.Raw, error) {
+	names := strings.Fields(rawNames)
+	for i, name := range names {
+		spec, _ := e.versionFor(p, name)
+		pinned, err := e.PinName(pm, name, spec)
+		if err != nil {
+			return "", err
+		}
+		names[i] = pinned
+	}
+	return tmpl.Raw(strings.Join(names, " ")), nil
+}
+
+// LockPackage queries the installed versions of a package for the lockfile.
+func (e *Engine) LockPackage(p *config.Package) (*lockfile.Package, error) {
+	ok, pm, err := e.IsInstalled(p)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("not installed")
+	}
+
+	lp := &lockfile.Package{Manager: pm, Versions: make(map[string]string)}
+	for _, name := range strings.Fields(p.ResolveName(e.Sys)) {
+		v, supported := e.InstalledVersion(pm, name)
+		if !supported {
+			return nil, fmt.Errorf("PM '%s' cannot report versions", pm)
+		}
+		if v == "" {
+			return nil, fmt.Errorf("no version reported for '%s'", name)
+		}
+		lp.Versions[name] = v
+	}
+	if len(lp.Versions) == 0 {
+		return nil, fmt.Errorf("no package names resolved")
+	}
+	return lp, nil
+}
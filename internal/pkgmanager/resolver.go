@@ -1,6 +1,7 @@
 package pkgmanager
 
 import (
+	"dotbuilder/internal/tmpl"
 	"dotbuilder/pkg/constants"
 	"fmt"
 	"strings"
@@ -58,6 +59,41 @@ func (e *Engine) resolveBatchTpl(pm string) string {
 	return ""
 }
 
+func (e *Engine) resolveRemoveTpl(pm string) string {
+	// 1. Custom
+	if pmDef, ok := e.RegisteredPMs[pm]; ok && pmDef.PmRemoveTpl != "" {
+		return pmDef.PmRemoveTpl
+	}
+
+	// 2. Base Map
+	if tpl, ok := constants.BaseRemoveTemplates[pm]; ok {
+		return tpl
+	}
+
+	return ""
+}
+
+// resolveUpgradeTpl returns the per-package upgrade template of a PM.
+func (e *Engine) resolveUpgradeTpl(pm string) string {
+	// 1. Custom
+	if pmDef, ok := e.RegisteredPMs[pm]; ok && pmDef.PmUpdateTpl != "" {
+		return pmDef.PmUpdateTpl
+	}
+
+	// 2. Constants Struct
+	_, _, update := constants.GetPMTemplates(pm)
+	if update != "" {
+		return update
+	}
+
+	// 3. Base Map
+	if tpl, ok := constants.BaseSingleUpgradeTemplates[pm]; ok {
+		return tpl
+	}
+
+	return ""
+}
+
 func (e *Engine) resolveUpdateCmd(pm string) string {
 	// 1. Custom
 	if pmDef, ok := e.RegisteredPMs[pm]; ok && pmDef.Upd != "" {
@@ -74,16 +110,16 @@ func (e *Engine) resolveUpdateCmd(pm string) string {
 
 // --- Builder ---
 
-func (e *Engine) BuildCheckCmd(pmName, rawPkgName string) string {
+func (e *Engine) BuildCheckCmd(pmName, rawPkgName string) (string, error) {
 	tpl := e.resolveCheckTpl(pmName)
 	if tpl == "" {
-		return ""
+		return "", nil
 	}
 
 	// 1. Split
 	names := strings.Fields(rawPkgName)
 	if len(names) == 0 {
-		return "false"
+		return "false", nil
 	}
 
 	// 2. Check
@@ -93,34 +129,42 @@ func (e *Engine) BuildCheckCmd(pmName, rawPkgName string) string {
 			"name": name,
 			"vars": e.Vars,
 		}
-		checks = append(checks, RenderCmd(tpl, data))
+		check, err := RenderCmd("check", tpl, data)
+		if err != nil {
+			return "", err
+		}
+		checks = append(checks, check)
 	}
 
-	return strings.Join(checks, " && ")
+	return strings.Join(checks, " && "), nil
 }
 
-func (e *Engine) BuildInstallCmd(pmName, pkgName string) string {
+// BuildInstallCmd installs names, already quoted as shell arguments.
+func (e *Engine) BuildInstallCmd(pmName string, names tmpl.Raw) (string, error) {
 	tpl := e.resolveInstallTpl(pmName)
 	
 	var cmd string
 	data := map[string]interface{}{
-		"name": pkgName,
+		"name": names,
 		"vars": e.Vars,
 	}
 
 	if tpl != "" {
-		cmd = RenderCmd(tpl, data)
+		var err error
+		if cmd, err = RenderCmd("install", tpl, data); err != nil {
+			return "", err
+		}
 	} else {
 		// Default Fallback: "apt-get install git"
-		cmd = fmt.Sprintf("%s install %s", pmName, pkgName)
+		cmd = fmt.Sprintf("%s install %s", pmName, names)
 	}
 
-	return e.applySudo(pmName, cmd)
+	return e.applySudo(pmName, cmd), nil
 }
 
-func (e *Engine) BuildBatchInstallCmd(pmName string, names []string) string {
+func (e *Engine) BuildBatchInstallCmd(pmName string, names []string) (string, error) {
 	if len(names) == 0 {
-		return ""
+		return "", nil
 	}
 
 	tpl := e.resolveBatchTpl(pmName)
@@ -130,25 +174,74 @@ func (e *Engine) BuildBatchInstallCmd(pmName string, names []string) string {
 		tpl = pmName + " install {{.names}}"
 	}
 
+	// Each name is its own quoted argument
 	data := map[string]interface{}{
-		"names": strings.Join(names, " "),
+		"names": tmpl.ShellArgs(strings.Join(names, " ")),
 		"vars":  e.Vars,
 	}
-	cmd := RenderCmd(tpl, data)
-	
-	return e.applySudo(pmName, cmd)
+	return e.renderWithSudo("install", pmName, tpl, data)
 }
 
-func (e *Engine) BuildSystemUpdateCmd(pmName string) string {
+func (e *Engine) BuildRemoveCmd(pmName, pkgName string) (string, error) {
+	tpl := e.resolveRemoveTpl(pmName)
+	if tpl == "" {
+		return "", nil
+	}
+
+	data := map[string]interface{}{
+		"name": tmpl.ShellArgs(pkgName),
+		"vars": e.Vars,
+	}
+	return e.renderWithSudo("remove", pmName, tpl, data)
+}
+
+func (e *Engine) BuildUpgradeCmd(pmName, pkgName string) (string, error) {
+	tpl := e.resolveUpgradeTpl(pmName)
+	if tpl == "" {
+		return "", nil
+	}
+
+	data := map[string]interface{}{
+		"name": tmpl.ShellArgs(pkgName),
+		"vars": e.Vars,
+	}
+	return e.renderWithSudo("upgrade", pmName, tpl, data)
+}
+
+// BuildBatchUpgradeCmd upgrades several packages at once, or chains single
+// upgrades when the PM has no batch form.
+func (e *Engine) BuildBatchUpgradeCmd(pmName string, names []string) (string, error) {
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	if tpl, ok := constants.BaseBatchUpgradeTemplates[pmName]; ok {
+		data := map[string]interface{}{
+			"names": tmpl.ShellArgs(strings.Join(names, " ")),
+			"vars":  e.Vars,
+		}
+		return e.renderWithSudo("upgrade", pmName, tpl, data)
+	}
+
+	var cmds []string
+	for _, name := range names {
+		cmd, err := e.BuildUpgradeCmd(pmName, name)
+		if err != nil || cmd == "" {
+			return "", err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+func (e *Engine) BuildSystemUpdateCmd(pmName string) (string, error) {
 	tpl := e.resolveUpdateCmd(pmName)
 	if tpl == "" {
-		return ""
+		return "", nil
 	}
 
 	data := map[string]interface{}{"vars": e.Vars}
-	cmd := RenderCmd(tpl, data)
-
-	return e.applySudo(pmName, cmd)
+	return e.renderWithSudo("update", pmName, tpl, data)
 }
 
 // --- Helper ---
@@ -161,3 +254,11 @@ func (e *Engine) applySudo(pmName, cmd string) string {
 	}
 	return cmd
 }
+
+func (e *Engine) renderWithSudo(name, pmName, tpl string, data map[string]interface{}) (string, error) {
+	cmd, err := RenderCmd(name, tpl, data)
+	if err != nil {
+		return "", err
+	}
+	return e.applySudo(pmName, cmd), nil
+}
@@ -1,14 +1,14 @@
 package pkgmanager
 
 import (
-	"bytes"
+	"dotbuilder/internal/tmpl"
 	"dotbuilder/pkg/logger"
+	"fmt"
 	"os"
 	"path/filepath"
-	"text/template"
 )
 
-func Prepare(scripts map[string]string, vars map[string]string) (string, error) {
+func Prepare(scripts map[string]string, vars map[string]interface{}) (string, error) {
 	if len(scripts) == 0 {
 		return "", nil
 	}
@@ -18,28 +18,54 @@ func Prepare(scripts map[string]string, vars map[string]string) (string, error)
 	if err := os.MkdirAll(tmpDir, 0755); err != nil {
 		return "", err
 	}
+	return tmpDir, writeScripts(tmpDir, scripts, vars)
+}
+
+// PrepareTemp writes the helper scripts to a new temporary directory, for
+// commands that must not replace the scripts of a run in progress. The
+// caller removes it.
+func PrepareTemp(scripts map[string]string, vars map[string]interface{}) (string, error) {
+	if len(scripts) == 0 {
+		return "", nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "dotbuilder_scripts_")
+	if err != nil {
+		return "", err
+	}
+	if err := writeScripts(tmpDir, scripts, vars); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return tmpDir, nil
+}
+
+func writeScripts(tmpDir string, scripts map[string]string, vars map[string]interface{}) error {
 
 	logger.Info("Preparing %d helper scripts in %s...", len(scripts), tmpDir)
 
 	data := map[string]interface{}{"vars": vars}
 
 	for name, content := range scripts {
-		tmpl, err := template.New(name).Parse(content)
+		rendered, err := tmpl.Render(name, content, data)
 		if err != nil {
-			logger.Warn("Failed to parse script [%s]: %v", name, err)
-			continue
-		}
-		var buf bytes.Buffer
-		if err := tmpl.Execute(&buf, data); err != nil {
-			logger.Warn("Failed to render script [%s]: %v", name, err)
-			continue
+			return fmt.Errorf("script [%s]: %w", name, err)
 		}
 
 		scriptPath := filepath.Join(tmpDir, name)
-		if err := os.WriteFile(scriptPath, buf.Bytes(), 0755); err != nil {
+		if err := os.WriteFile(scriptPath, []byte(rendered), 0755); err != nil {
 			logger.Error("Failed to write script [%s]: %v", name, err)
 		}
 	}
+	return nil
+}
 
-	return tmpDir, nil
-}
\ No newline at end of file
+// CheckScripts parses the helper scripts without rendering or writing them.
+func CheckScripts(scripts map[string]string) error {
+	for name, content := range scripts {
+		if _, err := tmpl.Parse(name, content); err != nil {
+			return fmt.Errorf("script [%s]: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -1,21 +1,12 @@
 package pkgmanager
 
 import (
-	"bytes"
-	"dotbuilder/pkg/logger"
-	"text/template"
+	"dotbuilder/internal/tmpl"
 )
 
-func RenderCmd(tplStr string, data interface{}) string {
-	tmpl, err := template.New("cmd").Parse(tplStr)
-	if err != nil {
-		logger.Warn("Template Parse Error: %v (Content: %s)", err, tplStr)
-		return tplStr // Fallback
-	}
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		logger.Warn("Template Execute Error: %v (Content: %s)", err, tplStr)
-		return tplStr
-	}
-	return buf.String()
-}
\ No newline at end of file
+// RenderCmd renders a command template, quoting interpolated values for
+// the shell. name is the field the template comes from, for errors; the
+// raw text is never run in place of a failed render.
+func RenderCmd(name, tplStr string, data interface{}) (string, error) {
+	return tmpl.RenderCmd(name, tplStr, data)
+}
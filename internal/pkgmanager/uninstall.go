@@ -0,0 +1,51 @@
+package pkgmanager
+
+import (
+	"dotbuilder/internal/config"
+	"dotbuilder/internal/errors"
+	"dotbuilder/pkg/logger"
+	"fmt"
+	"strings"
+)
+
+// Uninstall removes a package with its `clean` command or, without one,
+// with the remove template of the first manager whose check passes.
+func (e *Engine) Uninstall(p *config.Package) error {
+	tplData := e.pkgTplData(p)
+
+	pm := ""
+	if e.Runner.DryRun {
+		// Checks always fail in dry-run; plan the removal with the first manager.
+		pm = e.realPM(strings.TrimSpace(strings.Split(e.managerList(p), ";")[0]))
+	} else {
+		installed, found, err := e.IsInstalled(p)
+		if err != nil {
+			return err
+		}
+		if !installed {
+			logger.Success("[%s] Not installed (Checked).", p.Name)
+			return errors.NewSkipError("Not installed")
+		}
+		pm = found
+	}
+
+	var cmd string
+	var err error
+	if p.Clean != "" {
+		cmd, err = RenderCmd("clean", p.Clean, tplData)
+	} else {
+		cmd, err = e.BuildRemoveCmd(pm, p.ResolveName(e.Sys))
+		if err == nil && cmd == "" {
+			return fmt.Errorf("no remove command for PM '%s'; set 'clean' on package '%s'", pm, p.Name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.InfoPkg("Removing %s (%s)...", p.Name, pm)
+	unlock := e.acquireLock(pm)
+	defer unlock()
+
+	return e.Runner.ExecStream(cmd, p.Name)
+}
@@ -0,0 +1,113 @@
+package pkgmanager
+
+import (
+	"dotbuilder/internal/config"
+	"dotbuilder/internal/errors"
+	"dotbuilder/pkg/logger"
+	"fmt"
+	"strings"
+)
+
+// errNotInstalled is returned by tryInstallCore in NoInstall mode when the
+// check fails for a manager.
+var errNotInstalled = fmt.Errorf("not installed")
+
+// upgradeOne upgrades an installed package with its `upd` command or the
+// PM's per-package update template.
+func (e *Engine) upgradeOne(p *config.Package, pm string, tplData map[string]interface{}) error {
+	realPM := e.realPM(pm)
+	if realPM == "" {
+		realPM = e.Sys.BasePM
+	}
+
+	if e.lockedPackage(p) != nil {
+		logger.Success("[%s] Locked, not upgrading.", p.Name)
+		return errors.NewSkipError("Locked")
+	}
+	if spec := p.ResolveVersion(e.Sys); spec != "" && isExactVersion(spec) {
+		logger.Success("[%s] Pinned to %s, not upgrading.", p.Name, exactVersion(spec))
+		return errors.NewSkipError("Pinned")
+	}
+
+	var cmd string
+	var err error
+	if p.Upd != "" && p.PmInstallTpl == "" {
+		cmd, err = RenderCmd("upd", p.Upd, tplData)
+	} else {
+		cmd, err = e.BuildUpgradeCmd(realPM, p.ResolveName(e.Sys))
+	}
+	if err != nil {
+		return err
+	}
+
+	if cmd == "" {
+		logger.Success("[%s] Already installed, no upgrade command for '%s'.", p.Name, realPM)
+		return errors.NewSkipError("No upgrade command")
+	}
+
+	e.EnsurePMUpdated(realPM)
+	unlock := e.acquireLock(realPM)
+	defer unlock()
+
+	names := strings.Fields(p.ResolveName(e.Sys))
+	before, known := e.installedVersions(realPM, names)
+	logger.InfoPkg("Upgrading %s (%s)...", p.Name, realPM)
+	if err := e.Runner.ExecStream(cmd, p.Name); err != nil {
+		return err
+	}
+	return e.upgradeResult(realPM, names, before, known)
+}
+
+// installedVersions queries the installed version of every name. known is
+// false when the PM cannot report versions or nothing runs (dry-run).
+func (e *Engine) installedVersions(pm string, names []string) (versions map[string]string, known bool) {
+	if e.Runner.DryRun {
+		return nil, false
+	}
+	versions = make(map[string]string, len(names))
+	for _, name := range names {
+		v, ok := e.InstalledVersion(pm, name)
+		if !ok {
+			return nil, false
+		}
+		versions[name] = v
+	}
+	return versions, true
+}
+
+// upgradeResult tells an upgrade that changed a version, UPGRADED with the
+// old and new versions, from one that left everything as it was, SKIPPED.
+// Without versions to compare every upgrade counts.
+func (e *Engine) upgradeResult(pm string, names []string, before map[string]string, known bool) error {
+	if !known {
+		return errors.NewUpgradedError("Upgraded")
+	}
+	after, _ := e.installedVersions(pm, names)
+	var changed []string
+	for _, name := range names {
+		if after[name] != before[name] {
+			changed = append(changed, fmt.Sprintf("%s %s -> %s", name, orUnknown(before[name]), orUnknown(after[name])))
+		}
+	}
+	if len(changed) == 0 {
+		logger.Success("[%s] Already up to date.", strings.Join(names, " "))
+		return errors.NewSkipError("Already up to date")
+	}
+	return errors.NewUpgradedError("Upgraded %s", strings.Join(changed, ", "))
+}
+
+func orUnknown(v string) string {
+	if v == "" {
+		return "?"
+	}
+	return v
+}
+
+func (e *Engine) upgradeBatch(pmName string, names []string, cmd string) error {
+	e.EnsurePMUpdated(pmName)
+	unlock := e.acquireLock(pmName)
+	defer unlock()
+
+	logger.InfoPkg("[%s] Batch upgrading: %v", pmName, names)
+	return e.Runner.ExecStream(cmd, fmt.Sprintf("%s-upgrade", pmName))
+}
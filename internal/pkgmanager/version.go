@@ -0,0 +1,272 @@
+package pkgmanager
+
+import (
+	"dotbuilder/internal/tmpl"
+	"dotbuilder/pkg/constants"
+	"dotbuilder/pkg/logger"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// isExactVersion reports whether a version spec pins one version rather
+// than a range.
+func isExactVersion(spec string) bool {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "==") || (strings.HasPrefix(spec, "=") && !strings.HasPrefix(spec, "=>")) {
+		return !strings.Contains(spec, ",")
+	}
+	return spec != "" && strings.IndexAny(spec[:1], "<>!~^*") < 0 && !strings.Contains(spec, ",")
+}
+
+func exactVersion(spec string) string {
+	return strings.TrimLeft(strings.TrimSpace(spec), "=")
+}
+
+// PinName renders a package name with its version in the syntax of the PM,
+// quoted as shell arguments.
+// Managers without range support get the bare name for constraints.
+func (e *Engine) PinName(pm, name, spec string) (string, error) {
+	if spec == "" {
+		return tmpl.ShellArg(name), nil
+	}
+
+	tpl := constants.PinnedNameTemplates[pm]
+	version := exactVersion(spec)
+	if !isExactVersion(spec) {
+		tpl = constants.ConstraintNameTemplates[pm]
+		version = strings.TrimSpace(spec)
+		if pm == "npm" {
+			version = strings.ReplaceAll(version, ",", " ")
+		}
+	}
+
+	if tpl == "" {
+		logger.Warn("[%s] PM '%s' cannot install version '%s'; installing the default and verifying.", name, pm, spec)
+		return tmpl.ShellArg(name), nil
+	}
+
+	return RenderCmd("version", tpl, map[string]interface{}{
+		"name":    name,
+		"version": version,
+		"vars":    e.Vars,
+	})
+}
+
+// InstalledVersion queries the PM for the installed version of name. The
+// second value is false when the PM has no version query.
+func (e *Engine) InstalledVersion(pm, name string) (string, bool) {
+	tpl, ok := constants.VersionQueryTemplates[pm]
+	if !ok {
+		return "", false
+	}
+	cmd, err := RenderCmd("version", tpl, map[string]interface{}{"name": name, "vars": e.Vars})
+	if err != nil {
+		logger.Warn("[%s] Version query: %v", name, err)
+		return "", true
+	}
+	out, err := e.Runner.ExecOutput(cmd)
+	if err != nil {
+		return "", true
+	}
+	return out, true
+}
+
+// VersionSatisfies checks an installed version against an exact version or
+// a comma-separated list of constraints (>=, <=, >, <, !=, ==, ^, ~, ~=).
+func VersionSatisfies(installed, spec string) bool {
+	if installed == "" {
+		return false
+	}
+	if isExactVersion(spec) {
+		want := exactVersion(spec)
+		return installed == want || hasVersionPrefix(stripEpoch(installed), want)
+	}
+
+	for _, c := range strings.Split(spec, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		op := ""
+		if idx := strings.IndexFunc(c, isVersionChar); idx > 0 {
+			op = strings.TrimSpace(c[:idx])
+			c = strings.TrimSpace(c[idx:])
+		}
+		cmp := CompareVersions(installed, c)
+
+		ok := false
+		switch op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		case "=", "==", "":
+			ok = cmp == 0 || hasVersionPrefix(stripEpoch(installed), c)
+		case "^":
+			ok = cmp >= 0 && sameLeading(installed, c, 1)
+		case "~", "~=":
+			ok = cmp >= 0 && sameLeading(installed, c, len(versionParts(c))-1)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func isVersionChar(r rune) bool {
+	return unicode.IsDigit(r) || unicode.IsLetter(r)
+}
+
+// stripEpoch drops a Debian/RPM style "N:" epoch.
+func stripEpoch(v string) string {
+	if i := strings.Index(v, ":"); i >= 0 {
+		return v[i+1:]
+	}
+	return v
+}
+
+// versionParts splits a version on any non-alphanumeric separator.
+func versionParts(v string) []string {
+	return strings.FieldsFunc(stripEpoch(v), func(r rune) bool { return !isVersionChar(r) })
+}
+
+func hasVersionPrefix(installed, want string) bool {
+	got, exp := versionParts(installed), versionParts(want)
+	if len(exp) == 0 || len(got) < len(exp) {
+		return false
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameLeading reports whether the first n parts of both versions match.
+func sameLeading(a, b string, n int) bool {
+	pa, pb := versionParts(a), versionParts(b)
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		if i >= len(pa) || i >= len(pb) || pa[i] != pb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CompareVersions compares versions of the Debian form
+// [epoch:]upstream[~pre][-revision]. Upstream versions are compared part by
+// part, numerically where both parts are numbers, and missing trailing
+// parts count as lower. A ~pre suffix sorts before the release itself.
+// Epochs and revisions only count when both versions have one, so a
+// constraint written without them matches any.
+func CompareVersions(a, b string) int {
+	va, vb := splitVersion(a), splitVersion(b)
+	if va.epoch != "" && vb.epoch != "" {
+		if c := compareParts(va.epoch, vb.epoch); c != 0 {
+			return c
+		}
+	}
+	if c := compareParts(va.upstream, vb.upstream); c != 0 {
+		return c
+	}
+	switch {
+	case va.tilde && !vb.tilde:
+		return -1
+	case !va.tilde && vb.tilde:
+		return 1
+	case va.tilde && vb.tilde:
+		if c := compareParts(va.pre, vb.pre); c != 0 {
+			return c
+		}
+	}
+	if va.revision != "" && vb.revision != "" {
+		return compareParts(va.revision, vb.revision)
+	}
+	return 0
+}
+
+// version is a version split by splitVersion.
+type version struct {
+	epoch, upstream, pre, revision string
+	tilde                          bool // pre is set, possibly empty
+}
+
+func splitVersion(v string) version {
+	var out version
+	if i := strings.Index(v, ":"); i >= 0 {
+		out.epoch, v = v[:i], v[i+1:]
+	}
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		v, out.revision = v[:i], v[i+1:]
+	}
+	if i := strings.Index(v, "~"); i >= 0 {
+		v, out.pre, out.tilde = v[:i], v[i+1:], true
+	}
+	out.upstream = v
+	return out
+}
+
+// compareParts compares two versions part by part, see CompareVersions.
+func compareParts(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		if i >= len(pa) {
+			return -1
+		}
+		if i >= len(pb) {
+			return 1
+		}
+		if c := comparePart(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// comparePart compares one part in runs of letters and digits, as text and
+// as numbers, so 1ubuntu2 sorts before 1ubuntu10.
+func comparePart(a, b string) int {
+	for a != "" || b != "" {
+		la, lb := leadingRun(a, false), leadingRun(b, false)
+		if la != lb {
+			if la < lb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[len(la):], b[len(lb):]
+
+		da, db := leadingRun(a, true), leadingRun(b, true)
+		na, _ := strconv.Atoi(da)
+		nb, _ := strconv.Atoi(db)
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[len(da):], b[len(db):]
+	}
+	return 0
+}
+
+// leadingRun returns the leading digits of s, or its leading non-digits.
+func leadingRun(s string, digits bool) string {
+	i := strings.IndexFunc(s, func(r rune) bool { return unicode.IsDigit(r) != digits })
+	if i < 0 {
+		return s
+	}
+	return s[:i]
+}
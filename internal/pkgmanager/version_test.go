@@ -0,0 +1,138 @@
+package pkgmanager
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10", "1.9", 1},
+		{"2.0", "10.0", -1},
+
+		// Segment counts: missing trailing parts are lower
+		{"1.2", "1.2.0", -1},
+		{"1.2.0", "1.2", 1},
+		{"1", "1.0.1", -1},
+		{"1.2.3.4", "1.2.3", 1},
+
+		// Letters compare as text
+		{"1.2a", "1.2b", -1},
+		{"1.0.rc1", "1.0.rc2", -1},
+
+		// Epochs count when both have one, and win over the rest
+		{"1:1.0", "2:0.5", -1},
+		{"2:0.5", "1:9.9", 1},
+		{"1:1.0", "1:1.0", 0},
+		{"1:2.30", "2.30", 0},
+		{"1:2.30", "2.31", -1},
+
+		// ~ sorts before the release
+		{"1.0~rc1", "1.0", -1},
+		{"1.0", "1.0~rc1", 1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~rc1", "0.9", 1},
+		{"1.0~", "1.0~a", -1},
+
+		// Debian revisions count when both have one
+		{"1.2.3-1", "1.2.3-2", -1},
+		{"1.2.3-10", "1.2.3-9", 1},
+		{"1.2.3-1ubuntu2", "1.2.3-1ubuntu10", -1},
+		{"1.2.3-1ubuntu2", "1.2.3", 0},
+		{"1.2.3-1ubuntu2", "1.2.4", -1},
+		{"2.34-0ubuntu3.2", "2.34", 0},
+		{"1:9.2p1-2ubuntu0.3", "9.2", 1},
+		{"1.0~rc1-1", "1.0-1", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestVersionSatisfies(t *testing.T) {
+	tests := []struct {
+		installed, spec string
+		want            bool
+	}{
+		// Exact versions match as a prefix of the parts
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3", "1.2", true},
+		{"1.2.30", "1.2.3", false},
+		{"1.2.3-1ubuntu2", "1.2.3", true},
+		{"1:1.2.3-1", "1.2.3", true},
+		{"1.2.3", "=1.2.3", true},
+		{"1.2.3", "==1.2.4", false},
+		{"", "1.2.3", false},
+
+		{"1.4.0", ">=1.4", true},
+		{"1.3.9", ">=1.4", false},
+		{"1.4", ">1.4", false},
+		{"1.4.1", ">1.4", true},
+		{"1.4", "<=1.4", true},
+		{"1.4.1", "<=1.4.0", false},
+		{"1.3", "<1.4", true},
+		{"1.4~rc1", "<1.4", true},
+		{"1.4", "<1.4", false},
+		{"1.4", "!=1.5", true},
+		{"1.5", "!=1.5", false},
+		{"1.5.2", "==1.5", true},
+		{"1.5.2", "= 1.5.2", true},
+
+		// ^ keeps the major version
+		{"1.9.0", "^1.4", true},
+		{"1.3.0", "^1.4", false},
+		{"2.0.0", "^1.4", false},
+
+		// ~ and ~= keep all but the last part
+		{"1.4.9", "~1.4.2", true},
+		{"1.4.1", "~1.4.2", false},
+		{"1.5.0", "~1.4.2", false},
+		{"1.9", "~=1.4", true},
+		{"2.0", "~=1.4", false},
+
+		// Lists must all hold
+		{"1.5.0", ">=1.4, <2", true},
+		{"2.1.0", ">=1.4, <2", false},
+		{"1.3.0", ">=1.4,<2", false},
+		{"1.5.0", ">=1.4, !=1.5.0", false},
+
+		// Debian versions against plain constraints
+		{"1:2.39.2-1ubuntu1", ">=2.30", true},
+		{"1:2.39.2-1ubuntu1", "<=2.39.2", true},
+		{"1:2.39.2-1ubuntu1", "<2.39.2", false},
+		{"2.39.2-1ubuntu1", ">=2.39.2-2", false},
+	}
+	for _, tt := range tests {
+		if got := VersionSatisfies(tt.installed, tt.spec); got != tt.want {
+			t.Errorf("VersionSatisfies(%q, %q) = %v, want %v", tt.installed, tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestIsExactVersion(t *testing.T) {
+	for spec, want := range map[string]bool{
+		"1.2.3":     true,
+		"=1.2.3":    true,
+		"==1.2.3":   true,
+		"1:1.2-1":   true,
+		">=1.2":     false,
+		"^1.2":      false,
+		"~1.2":      false,
+		"!=1.2":     false,
+		"1.2, <2":   false,
+		"":          false,
+		"*":         false,
+		"<2":        false,
+		"==1.2,<2":  false,
+		" 1.2.3 ":   true,
+		"1.2.3~rc1": true,
+	} {
+		if got := isExactVersion(spec); got != want {
+			t.Errorf("isExactVersion(%q) = %v, want %v", spec, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package secrets reads the values of `secrets:` entries from encrypted
+// files or password-manager commands.
+package secrets
+
+import (
+	"bytes"
+	"dotbuilder/internal/config"
+	"dotbuilder/internal/vars"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Lazy wraps every secret so it is only read when a template uses it.
+func Lazy(specs map[string]*config.Secret) map[string]interface{} {
+	out := make(map[string]interface{}, len(specs))
+	for name, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		spec := spec
+		out[name] = vars.NewSecret(name, func() (string, error) { return Fetch(spec) })
+	}
+	return out
+}
+
+// Fetch reads one secret. Trailing newlines are dropped, as `pass show` and
+// most encrypted files end with one.
+func Fetch(spec *config.Secret) (string, error) {
+	var out string
+	var err error
+	switch {
+	case spec.Cmd != "":
+		out, err = run("sh", "-c", spec.Cmd)
+	case spec.File != "":
+		out, err = decrypt(spec)
+	default:
+		return "", fmt.Errorf("neither 'cmd' nor 'file' is set")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out, "\r\n"), nil
+}
+
+func decrypt(spec *config.Secret) (string, error) {
+	if _, err := os.Stat(spec.File); err != nil {
+		return "", err
+	}
+	switch strings.ToLower(filepath.Ext(spec.File)) {
+	case ".age":
+		identity := spec.Identity
+		if identity == "" {
+			home, _ := os.UserHomeDir()
+			identity = filepath.Join(home, ".config", "age", "keys.txt")
+		}
+		return run("age", "--decrypt", "--identity", os.ExpandEnv(identity), spec.File)
+	case ".gpg", ".asc":
+		return run("gpg", "--quiet", "--batch", "--decrypt", spec.File)
+	}
+	return "", fmt.Errorf("%s: unknown encryption (want .age, .gpg or .asc)", spec.File)
+}
+
+// run returns the stdout of a command; stderr is kept for the error only,
+// so nothing is printed while fetching.
+func run(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin // Password prompts
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,184 @@
+package state
+
+import (
+	"crypto/sha256"
+	"dotbuilder/pkg/redact"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const fileVersion = 1
+
+// Node kinds recorded in an Entry.
+const (
+	KindFile = "file"
+	KindPkg  = "pkg"
+	KindTask = "task"
+)
+
+// Entry is what dotbuilder last did for one node.
+type Entry struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Src       string    `json:"src,omitempty"`
+	Dest      string    `json:"dest,omitempty"`
+	Mode      string    `json:"mode,omitempty"` // link, copy, template, hardlink or append
+	Hash      string    `json:"hash,omitempty"` // sha256 of the destination content
+	Managed   bool      `json:"managed,omitempty"`
+	Package   string    `json:"package,omitempty"`
+	Manager   string    `json:"manager,omitempty"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	RunID     string    `json:"run_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Backup is an original file moved or copied aside before dotbuilder
+// removed or overwrote it.
+type Backup struct {
+	RunID     string    `json:"run_id"`
+	ID        string    `json:"id"`
+	Dest      string    `json:"dest"`
+	Path      string    `json:"path"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// State is the persistent record of previous runs, stored as JSON.
+type State struct {
+	Version int               `json:"version"`
+	Config  string            `json:"config,omitempty"`
+	LastRun string            `json:"last_run,omitempty"`
+	Entries map[string]*Entry `json:"entries"`
+	Backups []Backup          `json:"backups,omitempty"`
+
+	path string
+}
+
+// Dir returns $XDG_STATE_HOME/dotbuilder, defaulting to ~/.local/state/dotbuilder.
+func Dir() string {
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" {
+		home, _ := os.UserHomeDir()
+		base = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(base, "dotbuilder")
+}
+
+func DefaultPath() string {
+	return filepath.Join(Dir(), "state.json")
+}
+
+// NewRunID returns a sortable identifier for the current run.
+func NewRunID() string {
+	return time.Now().Format("20060102-150405.000")
+}
+
+// Load reads the state file; a missing file yields an empty state.
+func Load(path string) (*State, error) {
+	s := &State{
+		Version: fileVersion,
+		Entries: make(map[string]*Entry),
+		path:    path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Entries == nil {
+		s.Entries = make(map[string]*Entry)
+	}
+	s.path = path
+	return s, nil
+}
+
+// Save writes the state atomically.
+func (s *State) Save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Record stores what happened to a node. Only the message is redacted:
+// paths and hashes must stay exact for prune and restore.
+func (s *State) Record(e Entry) {
+	e.Message = redact.String(e.Message)
+	s.Entries[e.ID] = &e
+}
+
+func (s *State) Forget(id string) {
+	delete(s.Entries, id)
+}
+
+// LatestBackup returns the most recent backup recorded for a node ID.
+func (s *State) LatestBackup(id string) (Backup, bool) {
+	for i := len(s.Backups) - 1; i >= 0; i-- {
+		if s.Backups[i].ID == id {
+			return s.Backups[i], true
+		}
+	}
+	return Backup{}, false
+}
+
+// RunBackups returns every backup taken during a run.
+func (s *State) RunBackups(runID string) []Backup {
+	var out []Backup
+	for _, b := range s.Backups {
+		if b.RunID == runID {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// DropBackup removes a backup record once it has been restored.
+func (s *State) DropBackup(path string) {
+	for i, b := range s.Backups {
+		if b.Path == path {
+			s.Backups = append(s.Backups[:i], s.Backups[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sorted returns the entries ordered by ID.
+func (s *State) Sorted() []*Entry {
+	var out []*Entry
+	for _, e := range s.Entries {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// HashFile returns the hex sha256 of a file's content (following symlinks),
+// or "" if it cannot be read.
+func HashFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
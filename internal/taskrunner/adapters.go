@@ -4,6 +4,9 @@ import (
 	"dotbuilder/internal/config"
 	"dotbuilder/internal/filemanager"
 	"dotbuilder/internal/pkgmanager"
+	"dotbuilder/internal/state"
+	"fmt"
+	"strings"
 )
 
 // --- Package Node ---
@@ -12,11 +15,10 @@ type PkgNode struct {
 	Mgr *pkgmanager.Engine
 }
 
-func (n *PkgNode) ID() string {
-    if n.Pkg.Name != "" { return n.Pkg.Name }
-    return n.Pkg.Def
-}
+func (n *PkgNode) ID() string { return n.Pkg.NodeID() }
 func (n *PkgNode) Deps() []string { return n.Pkg.Deps }
+func (n *PkgNode) Tags() []string { return n.Pkg.Tags }
+func (n *PkgNode) When() string   { return n.Pkg.When }
 
 func (n *PkgNode) BatchGroup() string {
 	batchPM := n.Mgr.GetBatchManager(n.Pkg)
@@ -50,6 +52,8 @@ type TaskNode struct {
 
 func (n *TaskNode) ID() string     { return n.Task.ID }
 func (n *TaskNode) Deps() []string { return n.Task.Deps }
+func (n *TaskNode) Tags() []string { return n.Task.Tags }
+func (n *TaskNode) When() string   { return n.Task.When }
 func (n *TaskNode) BatchGroup() string { return "" }
 func (n *TaskNode) Group() string {
     if n.Task.Group == "" { return "default" }
@@ -68,6 +72,8 @@ type FileNode struct {
 
 func (n *FileNode) ID() string { return n.Id }
 func (n *FileNode) Deps() []string { return n.File.Deps }
+func (n *FileNode) Tags() []string { return n.File.Tags }
+func (n *FileNode) When() string   { return n.File.When }
 func (n *FileNode) BatchGroup() string { return "" }
 func (n *FileNode) Group() string {
     if n.File.Group == "" { return "default" }
@@ -81,5 +87,76 @@ func (n *FileNode) Execute(ctx *Context) error {
 	} else {
 		fs = filemanager.RealFS{}
 	}
-    return filemanager.ProcessSingleFile(n.File, ctx.Vars, fs, ctx.BaseDir, ctx.Shell)
+    f := n.File
+    f.ID = n.Id
+    return filemanager.ProcessSingleFile(f, ctx.Vars, fs, ctx.BaseDir, ctx.Shell, ctx.Backup)
+}
+
+// --- Inspection ---
+
+func (n *PkgNode) Inspect(ctx *Context) (SyncState, string) {
+	ok, pm, err := ctx.PkgManager.IsInstalled(n.Pkg)
+	if err != nil {
+		return SyncDrift, err.Error()
+	}
+	if ok {
+		return SyncOK, "installed via " + pm
+	}
+	return SyncDrift, "not installed"
+}
+
+func (n *TaskNode) Inspect(ctx *Context) (SyncState, string) {
+	if n.Task.Check == "" {
+		return SyncUnknown, "no check defined"
+	}
+	ok, err := checkTask(n.Task, ctx.Shell, ctx.Vars)
+	if err != nil {
+		return SyncDrift, err.Error()
+	}
+	if ok {
+		return SyncOK, "check passed"
+	}
+	return SyncDrift, "check failed"
+}
+
+func (n *FileNode) Inspect(ctx *Context) (SyncState, string) {
+	st, err := filemanager.Inspect(n.File, ctx.Vars, ctx.BaseDir)
+	if err != nil {
+		return SyncDrift, err.Error()
+	}
+	if st.State == filemanager.FileInSync {
+		return SyncOK, st.Dest
+	}
+	return SyncDrift, fmt.Sprintf("%s (%s)", st.Dest, strings.ToLower(st.State.String()))
+}
+
+// --- State ---
+
+func (n *PkgNode) StateEntry(ctx *Context) state.Entry {
+	return state.Entry{
+		Kind:    state.KindPkg,
+		Package: n.Pkg.ResolveName(n.Mgr.Sys),
+		Manager: n.Mgr.ManagerFor(n.Pkg),
+	}
+}
+
+func (n *TaskNode) StateEntry(ctx *Context) state.Entry {
+	return state.Entry{Kind: state.KindTask}
+}
+
+func (n *FileNode) StateEntry(ctx *Context) state.Entry {
+	e := state.Entry{Kind: state.KindFile, Mode: n.File.ResolveMode()}
+	if n.File.Append {
+		e.Mode = "append"
+	}
+
+	st, err := filemanager.Inspect(n.File, ctx.Vars, ctx.BaseDir)
+	if st != nil {
+		e.Src, e.Dest = st.Src, st.Dest
+	}
+	if err == nil && st.State == filemanager.FileInSync {
+		e.Managed = true
+		e.Hash = state.HashFile(st.Dest)
+	}
+	return e
 }
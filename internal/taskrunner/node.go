@@ -1,7 +1,10 @@
 package taskrunner
 
 import (
+	"dotbuilder/internal/filemanager"
 	"dotbuilder/internal/pkgmanager"
+	"dotbuilder/internal/state"
+	"dotbuilder/pkg/logger"
 	"dotbuilder/pkg/shell"
 	"time"
 )
@@ -14,8 +17,15 @@ const (
 	StatusFailed                 // Fail for Running
 	StatusSkipped                // Fail for Check
 	StatusBlocked              // Fail for Dependencies
+	StatusUpgraded             // Installed package was upgraded
+	StatusNotApplicable        // `when:` is false for this machine
 )
 
+// Satisfied reports whether dependents may run after a node with this status.
+func (s NodeStatus) Satisfied() bool {
+	return s == StatusSuccess || s == StatusSkipped || s == StatusUpgraded || s == StatusNotApplicable
+}
+
 func (s NodeStatus) String() string {
 	switch s {
 	case StatusSuccess:
@@ -26,11 +36,35 @@ func (s NodeStatus) String() string {
 		return "SKIPPED"
 	case StatusBlocked:
 		return "BLOCKED"
+	case StatusUpgraded:
+		return "UPGRADED"
+	case StatusNotApplicable:
+		return "NOT_APPLICABLE"
 	default:
 		return "PENDING"
 	}
 }
 
+// Color returns the ANSI color used to display the status.
+func (s NodeStatus) Color() string {
+	switch s {
+	case StatusSuccess:
+		return logger.Green
+	case StatusFailed:
+		return logger.Red
+	case StatusBlocked:
+		return logger.Yellow
+	case StatusSkipped:
+		return logger.Cyan
+	case StatusUpgraded:
+		return logger.Magenta
+	case StatusNotApplicable:
+		return logger.Gray
+	default:
+		return logger.Reset
+	}
+}
+
 type NodeResult struct {
 	ID        string
 	Status    NodeStatus
@@ -42,13 +76,17 @@ type NodeResult struct {
 type Context struct {
 	Shell      *shell.Runner
 	PkgManager *pkgmanager.Engine
-	Vars       map[string]string
+	Vars       map[string]interface{}
 	BaseDir    string // Directory of the config file, for relative paths
+	Detached   map[string]bool // Nodes left out by selection; deps on them count as satisfied
+	Backup     *filemanager.Backup
 }
 
 type Node interface {
 	ID() string
 	Deps() []string
+	Tags() []string
+	When() string // Condition; empty means always
 	
 	Execute(ctx *Context) error
 	BatchGroup() string
@@ -58,4 +96,63 @@ type Node interface {
 type BatchableNode interface {
 	Node
 	GetBatchItem() string
-}
\ No newline at end of file
+}
+type SyncState int
+
+const (
+	SyncUnknown SyncState = iota // Cannot be determined without running
+	SyncOK                       // Machine matches the config
+	SyncDrift                    // Missing or differs from the config
+	SyncNotApplicable            // `when:` is false for this machine
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SyncOK:
+		return "OK"
+	case SyncDrift:
+		return "DRIFT"
+	case SyncNotApplicable:
+		return "N/A"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// InspectableNode reports whether the desired state is already in place
+// without changing anything.
+type InspectableNode interface {
+	Node
+	Inspect(ctx *Context) (SyncState, string)
+}
+
+// StatefulNode describes what it manages so runs can be recorded.
+type StatefulNode interface {
+	Node
+	StateEntry(ctx *Context) state.Entry
+}
+
+// RecordResults stores the outcome of every executed node in st.
+func RecordResults(st *state.State, runID string, results map[string]NodeResult, nodes []Node, ctx *Context) {
+	for _, n := range nodes {
+		res, ok := results[n.ID()]
+		// Keep whatever an earlier run recorded for nodes that did not apply.
+		if !ok || res.Status == StatusNotApplicable {
+			continue
+		}
+
+		var e state.Entry
+		if sn, ok := n.(StatefulNode); ok {
+			e = sn.StateEntry(ctx)
+		}
+		e.ID = n.ID()
+		e.Status = res.Status.String()
+		if res.Error != nil {
+			e.Message = res.Error.Error()
+		}
+		e.RunID = runID
+		e.Timestamp = res.Timestamp
+		st.Record(e)
+	}
+	st.LastRun = runID
+}
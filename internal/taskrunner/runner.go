@@ -1,17 +1,19 @@
 package taskrunner
 
 import (
-	"bytes"
 	"dotbuilder/internal/config"
 	"dotbuilder/internal/dag"
 	"dotbuilder/internal/pkgmanager"
+	"dotbuilder/internal/state"
+	"dotbuilder/internal/tmpl"
+	"dotbuilder/internal/vars"
 	"dotbuilder/pkg/logger"
+	"dotbuilder/pkg/redact"
 	"dotbuilder/pkg/shell"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
 	commone "dotbuilder/internal/errors"
 	"errors"
@@ -35,38 +37,55 @@ func (r *ResultMap) Get(id string) (NodeResult, bool) {
 	return res, ok
 }
 
-func resolveMapVariables(vars map[string]string) {
-	data := map[string]interface{}{"vars": vars}
-	for k, v := range vars {
-		if strings.Contains(v, "{{") {
-			tmpl, err := template.New("v").Parse(v)
-			if err == nil {
-				var buf bytes.Buffer
-				if err := tmpl.Execute(&buf, data); err == nil {
-					vars[k] = buf.String()
-				}
-			}
-		}
+// taskTplData resolves task vars over the global vars, which are already
+// resolved and left as they are.
+func taskTplData(t config.Task, globalVars map[string]interface{}) (map[string]interface{}, error) {
+	resolved, err := vars.ResolveOver(globalVars, t.Vars)
+	if err != nil {
+		return nil, fmt.Errorf("task [%s]: %w", t.ID, err)
 	}
-}
 
-func ExecuteTaskLogic(t config.Task, runner *shell.Runner, globalVars map[string]string) error {
-	logger.Debug("Task Logic: [%s]", t.ID)
+	return map[string]interface{}{
+		"vars": resolved,
+		"name": t.ID,
+	}, nil
+}
 
-	// Merge Vars
-	vars := make(map[string]string)
-	for k, v := range globalVars {
-		vars[k] = v
+// runTaskCheck evaluates a task check; "exists:<path>" tests for a path,
+// anything else is run as a shell command.
+func runTaskCheck(t config.Task, runner *shell.Runner, tplData map[string]interface{}) (bool, error) {
+	if strings.HasPrefix(t.Check, "exists:") {
+		// A path, not a command: no shell quoting
+		path, err := tmpl.Render("check", strings.TrimPrefix(t.Check, "exists:"), tplData)
+		if err != nil {
+			return false, err
+		}
+		path = strings.TrimSpace(path)
+		path = os.ExpandEnv(path)
+		_, err = os.Stat(path)
+		return err == nil, nil
 	}
-	for k, v := range t.Vars {
-		vars[k] = v
+	cmd, err := pkgmanager.RenderCmd("check", t.Check, tplData)
+	if err != nil {
+		return false, err
 	}
+	return runner.ExecSilent(cmd) == 0, nil
+}
 
-	resolveMapVariables(vars)
+func checkTask(t config.Task, runner *shell.Runner, globalVars map[string]interface{}) (bool, error) {
+	tplData, err := taskTplData(t, globalVars)
+	if err != nil {
+		return false, err
+	}
+	return runTaskCheck(t, runner, tplData)
+}
 
-	tplData := map[string]interface{}{
-		"vars": vars,
-		"name": t.ID,
+func ExecuteTaskLogic(t config.Task, runner *shell.Runner, globalVars map[string]interface{}) error {
+	logger.Debug("Task Logic: [%s]", t.ID)
+
+	tplData, err := taskTplData(t, globalVars)
+	if err != nil {
+		return err
 	}
 
 	checkPassed := false
@@ -74,18 +93,8 @@ func ExecuteTaskLogic(t config.Task, runner *shell.Runner, globalVars map[string
 
 	if t.Check != "" {
 		checkRun = true
-		renderedCheck := pkgmanager.RenderCmd(t.Check, tplData)
-
-		if strings.HasPrefix(renderedCheck, "exists:") {
-			path := strings.TrimSpace(strings.TrimPrefix(renderedCheck, "exists:"))
-			path = os.ExpandEnv(path)
-			if _, err := os.Stat(path); err == nil {
-				checkPassed = true
-			}
-		} else {
-			if runner.ExecSilent(renderedCheck) == 0 {
-				checkPassed = true
-			}
+		if checkPassed, err = runTaskCheck(t, runner, tplData); err != nil {
+			return err
 		}
 	}
 
@@ -115,7 +124,10 @@ func ExecuteTaskLogic(t config.Task, runner *shell.Runner, globalVars map[string
 	}
 
 	if shouldRun {
-		runCmd := pkgmanager.RenderCmd(t.Run, tplData)
+		runCmd, err := pkgmanager.RenderCmd("run", t.Run, tplData)
+		if err != nil {
+			return err
+		}
 		logger.InfoTask("Running [%s]", t.ID)
 		if err := runner.ExecStream(runCmd, t.ID); err != nil {
 			return err
@@ -125,10 +137,43 @@ func ExecuteTaskLogic(t config.Task, runner *shell.Runner, globalVars map[string
 	return nil
 }
 
-func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
-	results := &ResultMap{m: make(map[string]NodeResult)}
+// NewResult maps the error returned by a node to its result: nil is a
+// success, a SkipError a skip, an UpgradedError an upgrade and anything
+// else a failure.
+func NewResult(id string, start time.Time, err error) NodeResult {
+	status := StatusSuccess
+	if err != nil {
+		var skipErr *commone.SkipError
+		var upgradedErr *commone.UpgradedError
+		if errors.As(err, &skipErr) {
+			status = StatusSkipped
+		} else if errors.As(err, &upgradedErr) {
+			status = StatusUpgraded
+		} else {
+			status = StatusFailed
+		}
 
-	// 1. Build DAG
+		// Name the node in template errors so the summary shows where
+		// the failing template is used.
+		var tplErr *tmpl.Error
+		if errors.As(err, &tplErr) && tplErr.Node == "" {
+			tplErr.Node = id
+		}
+	}
+
+	return NodeResult{
+		ID:        id,
+		Status:    status,
+		Error:     redact.Error(err),
+		Duration:  time.Since(start),
+		Timestamp: time.Now(),
+	}
+}
+
+// buildGraph validates node IDs and dependencies and returns the DAG along
+// with an ID lookup table and the IDs in declaration order. Dependencies on
+// detached nodes are left out of the graph.
+func buildGraph(nodes []Node, detached map[string]bool) (*dag.Graph, map[string]Node, []string, error) {
 	g := dag.New()
 	nodeMap := make(map[string]Node)
 	var ids []string
@@ -136,33 +181,54 @@ func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
 	for _, n := range nodes {
 		id := n.ID()
 		if _, exists := nodeMap[id]; exists {
-			logger.Error("Duplicate node ID detected: '%s'. Node IDs must be unique across all packages, tasks, and file 'id' fields.", id)
-			os.Exit(1)
+			return nil, nil, nil, fmt.Errorf("duplicate node ID detected: '%s'. Node IDs must be unique across all packages, tasks, and file 'id' fields", id)
 		}
 		nodeMap[id] = n
 		ids = append(ids, id)
 	}
 
-	// 2. Build Edges
 	for _, n := range nodes {
 		id := n.ID()
 		for _, dep := range n.Deps() {
+			if detached[dep] {
+				continue
+			}
 			if _, exists := nodeMap[dep]; !exists {
-				logger.Error("Node [%s] depends on missing node [%s]. Aborting.", id, dep)
-				os.Exit(1)
+				return nil, nil, nil, fmt.Errorf("node [%s] depends on missing node [%s]", id, dep)
 			}
 			g.AddEdge(dep, id)
 		}
 	}
 
-	// 3. Sort and Layer
+	return g, nodeMap, ids, nil
+}
+
+// Layers returns the execution layers of a single stage.
+func Layers(nodes []Node, detached map[string]bool) ([][]string, error) {
+	g, _, ids, err := buildGraph(nodes, detached)
+	if err != nil {
+		return nil, err
+	}
+	return g.SortLayers(ids)
+}
+
+func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
+	results := &ResultMap{m: make(map[string]NodeResult)}
+
+	// 1. Build DAG & Edges
+	g, nodeMap, ids, err := buildGraph(nodes, ctx.Detached)
+	if err != nil {
+		logger.Error("%v. Aborting.", err)
+	}
+
+	// 2. Sort and Layer
 	layers, err := g.SortLayers(ids)
 	if err != nil {
 		logger.Error("DAG Error: %v", err)
 		os.Exit(1)
 	}
 
-	// 4. Loop
+	// 3. Loop
 	for i, layer := range layers {
 		logger.Info("--- Layer %d (%d items) ---", i+1, len(layer))
 
@@ -172,12 +238,37 @@ func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
 		for _, id := range layer {
 			n := nodeMap[id]
 
+			applicable, err := Applicable(n, ctx)
+			if err != nil {
+				results.Set(id, NodeResult{
+					ID:        id,
+					Status:    StatusFailed,
+					Error:     err,
+					Timestamp: time.Now(),
+				})
+				logger.Warn("[%s] %v", id, err)
+				continue
+			}
+			if !applicable {
+				results.Set(id, NodeResult{
+					ID:        id,
+					Status:    StatusNotApplicable,
+					Error:     commone.NewSkipError("when: %s", n.When()),
+					Timestamp: time.Now(),
+				})
+				logger.Info("[%s] Not applicable (when: %s)", id, n.When())
+				continue
+			}
+
 			isBlocked := false
 			var failedDep string
 
 			for _, dep := range n.Deps() {
+				if ctx.Detached[dep] {
+					continue
+				}
 				res, ok := results.Get(dep)
-				if !ok || (res.Status != StatusSuccess && res.Status != StatusSkipped) {
+				if !ok || !res.Status.Satisfied() {
 					isBlocked = true
 					failedDep = dep
 					break
@@ -227,24 +318,8 @@ func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
 
 				err := ctx.PkgManager.InstallBatch(pm, pkgNames)
 
-				status := StatusSuccess
-				if err != nil {
-					var skipErr *commone.SkipError
-					if errors.As(err, &skipErr) {
-						status = StatusSkipped
-					} else {
-						status = StatusFailed
-					}
-				}
-
 				for _, id := range ids {
-					results.Set(id, NodeResult{
-						ID:        id,
-						Status:    status,
-						Error:     err,
-						Duration:  time.Since(start),
-						Timestamp: time.Now(),
-					})
+					results.Set(id, NewResult(id, start, err))
 				}
 			}(groupName, names, nodeIDs)
 		}
@@ -257,24 +332,7 @@ func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
 
 				err := node.Execute(ctx)
 
-				status := StatusSuccess
-
-				if err != nil {
-					var skipErr *commone.SkipError
-					if errors.As(err, &skipErr) {
-						status = StatusSkipped
-					} else {
-						status = StatusFailed
-					}
-				}
-
-				results.Set(node.ID(), NodeResult{
-					ID:        node.ID(),
-					Status:    status,
-					Error:     err,
-					Duration:  time.Since(start),
-					Timestamp: time.Now(),
-				})
+				results.Set(node.ID(), NewResult(node.ID(), start, err))
 			}(n)
 		}
 
@@ -284,7 +342,16 @@ func RunGeneric(nodes []Node, ctx *Context) map[string]NodeResult {
 	return results.m
 }
 
-func RunPhased(nodes []Node, ctx *Context) map[string]NodeResult {
+// StageOrder is the fixed order in which node groups are executed.
+var StageOrder = []string{"boot", "default", "end"}
+
+type Stage struct {
+	Name  string
+	Nodes []Node
+}
+
+// SplitStages distributes nodes over StageOrder; unknown groups fall back to "default".
+func SplitStages(nodes []Node) []Stage {
     stages := map[string][]Node{
         "boot":    {},
         "default": {},
@@ -299,12 +366,34 @@ func RunPhased(nodes []Node, ctx *Context) map[string]NodeResult {
         stages[g] = append(stages[g], n)
     }
 
-    order := []string{"boot", "default", "end"}
+    var out []Stage
+    for _, name := range StageOrder {
+        out = append(out, Stage{Name: name, Nodes: stages[name]})
+    }
+    return out
+}
+
+// Validate checks every stage for duplicate IDs, missing dependencies and cycles
+// without executing anything.
+func Validate(nodes []Node) []error {
+    var errs []error
+    for _, st := range SplitStages(nodes) {
+        if len(st.Nodes) == 0 {
+            continue
+        }
+        if _, err := Layers(st.Nodes, nil); err != nil {
+            errs = append(errs, fmt.Errorf("stage [%s]: %w", st.Name, err))
+        }
+    }
+    return errs
+}
+
+func RunPhased(nodes []Node, ctx *Context) map[string]NodeResult {
     allResults := make(map[string]NodeResult)
     previousStageFailed := false
 
-    for _, stageName := range order {
-        stageNodes := stages[stageName]
+    for _, st := range SplitStages(nodes) {
+        stageName, stageNodes := st.Name, st.Nodes
         if len(stageNodes) == 0 {
             continue
         }
@@ -313,9 +402,10 @@ func RunPhased(nodes []Node, ctx *Context) map[string]NodeResult {
         if previousStageFailed {
             for _, n := range stageNodes {
                 allResults[n.ID()] = NodeResult{
-                    ID:     n.ID(),
-                    Status: StatusBlocked,
-                    Error:  fmt.Errorf("Failure in previous stage"),
+                    ID:        n.ID(),
+                    Status:    StatusBlocked,
+                    Error:     fmt.Errorf("Failure in previous stage"),
+                    Timestamp: time.Now(),
                 }
             }
             continue
@@ -348,104 +438,45 @@ func truncateString(str string, num int) string {
 
 
 
-func PrintSummary(results map[string]NodeResult, nodes []Node) {
-	type rowData struct {
-		id       string
-		status   string
-		duration string
-		message  string
-		rawStat  NodeStatus
-	}
-
-	var rows []rowData
+// PrintSummary renders the result table and returns the number of failed or blocked nodes.
+func PrintSummary(results map[string]NodeResult, nodes []Node) int {
 	headers := []string{"ID", "STATUS", "DURATION", "MESSAGE"}
-	colWidths := []int{len(headers[0]), len(headers[1]), len(headers[2]), len(headers[3])}
+	var rows [][]string
+	var colors []string
 
 	for _, n := range nodes {
 		id := n.ID()
 		res, ok := results[id]
 
-		r := rowData{
-			id:      id,
-			status:  "UNKNOWN",
-			duration: "-",
-			message:  "",
-			rawStat:  StatusPending,
-		}
+		status, duration, message := "UNKNOWN", "-", ""
+		colorCode := logger.Reset
 
 		if ok {
-			r.rawStat = res.Status
-			r.status = res.Status.String()
-			r.duration = res.Duration.Round(time.Millisecond).String()
+			status = res.Status.String()
+			duration = res.Duration.Round(time.Millisecond).String()
 
 			if res.Error != nil {
 				var skipErr *commone.SkipError
+				var upgradedErr *commone.UpgradedError
 				if errors.As(res.Error, &skipErr) {
-					r.message = skipErr.Reason
+					message = skipErr.Reason
+				} else if errors.As(res.Error, &upgradedErr) {
+					message = upgradedErr.Reason
 				} else {
-					r.message = truncateString(res.Error.Error(), 40)
+					message = truncateString(res.Error.Error(), 40)
 				}
 			}
-            if r.rawStat == StatusSuccess {
-                r.message = ""
+            if res.Status == StatusSuccess {
+                message = ""
             }
+			colorCode = res.Status.Color()
 		}
 
-		if len(r.id) > colWidths[0] { colWidths[0] = len(r.id) }
-		if len(r.status) > colWidths[1] { colWidths[1] = len(r.status) }
-		if len(r.duration) > colWidths[2] { colWidths[2] = len(r.duration) }
-		if len(r.message) > colWidths[3] { colWidths[3] = len(r.message) }
-
-		rows = append(rows, r)
-	}
-
-	for i := range colWidths {
-		colWidths[i] += 2
+		rows = append(rows, []string{id, status, duration, message})
+		colors = append(colors, colorCode)
 	}
 
-	drawSeparator := func(left, mid, right, line string) {
-		fmt.Print(left)
-		for i, w := range colWidths {
-			fmt.Print(strings.Repeat(line, w))
-			if i < len(colWidths)-1 {
-				fmt.Print(mid)
-			}
-		}
-		fmt.Println(right)
-	}
-
-	drawSeparator("┌", "┬", "┐", "─")
-	fmt.Printf("│ %-*s │ %-*s │ %-*s │ %-*s │\n",
-		colWidths[0]-2, headers[0],
-		colWidths[1]-2, headers[1],
-		colWidths[2]-2, headers[2],
-		colWidths[3]-2, headers[3])
-	drawSeparator("├", "┼", "┤", "─")
-	for _, row := range rows {
-		colorCode := logger.Reset
-		switch row.rawStat {
-		case StatusSuccess:
-			colorCode = logger.Green
-		case StatusFailed:
-			colorCode = logger.Red
-		case StatusBlocked:
-			colorCode = logger.Yellow
-		case StatusSkipped:
-			colorCode = logger.Cyan
-		}
-		fmt.Printf("│ %-*s │ ", colWidths[0]-2, row.id)
-
-		fmt.Print(colorCode + row.status + logger.Reset)
-		padding := colWidths[1] - 2 - len(row.status)
-		if padding > 0 {
-			fmt.Print(strings.Repeat(" ", padding))
-		}
-
-		fmt.Printf(" │ %-*s │ %-*s │\n",
-			colWidths[2]-2, row.duration,
-			colWidths[3]-2, row.message)
-	}
-	drawSeparator("└", "┴", "┘", "─")
+	printTable(headers, rows, 1, colors)
 
     var failures []NodeResult
     for _, n := range nodes {
@@ -459,8 +490,82 @@ func PrintSummary(results map[string]NodeResult, nodes []Node) {
     if len(failures) > 0 {
         fmt.Println("\n=== Failure Details ===")
         for _, f := range failures {
-            logger.Error("[%s] Full Error: %v", f.ID, f.Error)
+            logger.Fail("[%s] Full Error: %v", f.ID, f.Error)
         }
-        logger.Error("Build finished with errors.")
+        logger.Fail("Build finished with errors.")
     }
+    return len(failures)
+}
+
+// Inspect reports the sync state of every node without executing anything.
+func Inspect(nodes []Node, ctx *Context) (map[string]SyncState, map[string]string) {
+	states := make(map[string]SyncState)
+	details := make(map[string]string)
+	for _, n := range nodes {
+		if applicable, err := Applicable(n, ctx); err != nil {
+			states[n.ID()], details[n.ID()] = SyncUnknown, err.Error()
+			continue
+		} else if !applicable {
+			states[n.ID()], details[n.ID()] = SyncNotApplicable, "when: "+n.When()
+			continue
+		}
+		in, ok := n.(InspectableNode)
+		if !ok {
+			states[n.ID()] = SyncUnknown
+			continue
+		}
+		states[n.ID()], details[n.ID()] = in.Inspect(ctx)
+	}
+	return states, details
+}
+
+// PrintStatus renders the result of Inspect and returns the number of drifted nodes.
+func PrintStatus(states map[string]SyncState, details map[string]string, nodes []Node) int {
+	headers := []string{"ID", "STATE", "DETAIL"}
+	var rows [][]string
+	var colors []string
+	drift := 0
+
+	for _, n := range nodes {
+		id := n.ID()
+		st := states[id]
+		color := logger.Gray
+		switch st {
+		case SyncOK:
+			color = logger.Green
+		case SyncDrift:
+			color = logger.Yellow
+			drift++
+		}
+		rows = append(rows, []string{id, st.String(), truncateString(redact.String(details[id]), 60)})
+		colors = append(colors, color)
+	}
+
+	printTable(headers, rows, 1, colors)
+	return drift
+}
+
+// PrintManaged lists what previous runs recorded in the state file.
+func PrintManaged(st *state.State) {
+	headers := []string{"ID", "KIND", "TARGET", "LAST STATUS", "RUN"}
+	var rows [][]string
+	var colors []string
+
+	for _, e := range st.Sorted() {
+		target := e.Dest
+		if e.Kind == state.KindPkg {
+			target = e.Package
+			if e.Manager != "" {
+				target += " (" + e.Manager + ")"
+			}
+		}
+		color := logger.Reset
+		if e.Managed || e.Kind != state.KindFile {
+			color = logger.Green
+		}
+		rows = append(rows, []string{e.ID, e.Kind, truncateString(target, 60), e.Status, e.RunID})
+		colors = append(colors, color)
+	}
+
+	printTable(headers, rows, 0, colors)
 }
@@ -0,0 +1,119 @@
+package taskrunner
+
+import (
+	"dotbuilder/internal/dag"
+	"fmt"
+	"strings"
+)
+
+// Selector narrows the node set for a run. Only/Tags/Groups pick the
+// starting set (everything when all are empty), Skip/SkipTags/SkipGroups
+// remove nodes afterwards. Groups are the stages of StageOrder.
+type Selector struct {
+	Only       []string
+	Skip       []string
+	Tags       []string
+	SkipTags   []string
+	Groups     []string
+	SkipGroups []string
+	NoDeps     bool // Do not pull in the transitive dependencies of selected nodes
+}
+
+func (s Selector) IsEmpty() bool {
+	return len(s.Only) == 0 && len(s.Skip) == 0 && len(s.Tags) == 0 && len(s.SkipTags) == 0 &&
+		len(s.Groups) == 0 && len(s.SkipGroups) == 0
+}
+
+func hasAnyTag(n Node, tags map[string]bool) bool {
+	for _, t := range n.Tags() {
+		if tags[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// stageOf is the stage a node runs in, as SplitStages places it.
+func stageOf(n Node) string {
+	for _, s := range StageOrder {
+		if n.Group() == s {
+			return s
+		}
+	}
+	return "default"
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, i := range items {
+		set[i] = true
+	}
+	return set
+}
+
+// Select applies the selector and returns the chosen nodes in their original
+// order, plus the IDs of the nodes left out. Dependencies on left-out nodes
+// are treated as satisfied by the runner (see Context.Detached).
+func Select(nodes []Node, sel Selector) ([]Node, map[string]bool, error) {
+	if sel.IsEmpty() {
+		return nodes, nil, nil
+	}
+
+	g := dag.New()
+	nodeMap := make(map[string]Node)
+	for _, n := range nodes {
+		nodeMap[n.ID()] = n
+		for _, dep := range n.Deps() {
+			g.AddEdge(dep, n.ID())
+		}
+	}
+
+	for _, id := range append(append([]string{}, sel.Only...), sel.Skip...) {
+		if _, ok := nodeMap[id]; !ok {
+			return nil, nil, fmt.Errorf("unknown node ID: %s", id)
+		}
+	}
+	stages := toSet(StageOrder)
+	for _, g := range append(append([]string{}, sel.Groups...), sel.SkipGroups...) {
+		if !stages[g] {
+			return nil, nil, fmt.Errorf("unknown group: %s (want %s)", g, strings.Join(StageOrder, ", "))
+		}
+	}
+
+	var seeds []string
+	if len(sel.Only) == 0 && len(sel.Tags) == 0 && len(sel.Groups) == 0 {
+		for _, n := range nodes {
+			seeds = append(seeds, n.ID())
+		}
+	} else {
+		seeds = append(seeds, sel.Only...)
+		tags := toSet(sel.Tags)
+		groups := toSet(sel.Groups)
+		for _, n := range nodes {
+			if hasAnyTag(n, tags) || groups[stageOf(n)] {
+				seeds = append(seeds, n.ID())
+			}
+		}
+	}
+
+	if !sel.NoDeps {
+		seeds = g.Ancestors(seeds)
+	}
+
+	chosen := toSet(seeds)
+	skip := toSet(sel.Skip)
+	skipTags := toSet(sel.SkipTags)
+	skipGroups := toSet(sel.SkipGroups)
+
+	var selected []Node
+	detached := make(map[string]bool)
+	for _, n := range nodes {
+		id := n.ID()
+		if chosen[id] && !skip[id] && !hasAnyTag(n, skipTags) && !skipGroups[stageOf(n)] {
+			selected = append(selected, n)
+		} else {
+			detached[id] = true
+		}
+	}
+	return selected, detached, nil
+}
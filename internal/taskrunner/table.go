@@ -0,0 +1,63 @@
+package taskrunner
+
+import (
+	"dotbuilder/pkg/logger"
+	"fmt"
+	"strings"
+)
+
+// printTable draws a box table. The column at colorCol is wrapped in the
+// per-row color code, padding is computed on the uncolored text.
+func printTable(headers []string, rows [][]string, colorCol int, colors []string) {
+	colWidths := make([]int, len(headers))
+	for i, h := range headers {
+		colWidths[i] = len(h)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > colWidths[i] {
+				colWidths[i] = len(cell)
+			}
+		}
+	}
+
+	for i := range colWidths {
+		colWidths[i] += 2
+	}
+
+	drawSeparator := func(left, mid, right, line string) {
+		fmt.Print(left)
+		for i, w := range colWidths {
+			fmt.Print(strings.Repeat(line, w))
+			if i < len(colWidths)-1 {
+				fmt.Print(mid)
+			}
+		}
+		fmt.Println(right)
+	}
+
+	drawRow := func(cells []string, colorCode string) {
+		fmt.Print("│")
+		for i, cell := range cells {
+			fmt.Print(" ")
+			if i == colorCol && colorCode != "" {
+				fmt.Print(colorCode + cell + logger.Reset)
+			} else {
+				fmt.Print(cell)
+			}
+			if padding := colWidths[i] - 2 - len(cell); padding > 0 {
+				fmt.Print(strings.Repeat(" ", padding))
+			}
+			fmt.Print(" │")
+		}
+		fmt.Println()
+	}
+
+	drawSeparator("┌", "┬", "┐", "─")
+	drawRow(headers, "")
+	drawSeparator("├", "┼", "┤", "─")
+	for i, row := range rows {
+		drawRow(row, colors[i])
+	}
+	drawSeparator("└", "┴", "┘", "─")
+}
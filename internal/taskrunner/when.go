@@ -0,0 +1,31 @@
+package taskrunner
+
+import (
+	"dotbuilder/internal/expr"
+	"dotbuilder/internal/vars"
+	"strings"
+)
+
+// Facts returns the bare identifiers available to `when:` conditions: the
+// sys_* variables plus hostname.
+func Facts(vars map[string]string) map[string]string {
+	facts := make(map[string]string)
+	for k, v := range vars {
+		if strings.HasPrefix(k, "sys_") {
+			facts[k] = v
+		}
+	}
+	facts["hostname"] = vars["sys_hostname"]
+	return facts
+}
+
+// Applicable evaluates the `when:` condition of a node; nodes without one
+// always apply. Vars are compared as strings.
+func Applicable(n Node, ctx *Context) (bool, error) {
+	cond := strings.TrimSpace(n.When())
+	if cond == "" {
+		return true, nil
+	}
+	strs := vars.Strings(ctx.Vars)
+	return expr.Eval(cond, &expr.Env{Facts: Facts(strs), Vars: strs})
+}
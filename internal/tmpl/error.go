@@ -0,0 +1,83 @@
+package tmpl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Error is a template that failed to parse or execute. Node is filled in
+// by the task runner so the message names the node that used it.
+type Error struct {
+	Node     string
+	Template string // Template name: a file path or what the text is for
+	Line     int
+	Col      int
+	Expr     string // Offending expression, when known
+	Source   string // Source line of the template at Line
+	Reason   string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Node != "" {
+		fmt.Fprintf(&b, "[%s] ", e.Node)
+	}
+	fmt.Fprintf(&b, "template %s", e.Template)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	if e.Col > 0 {
+		fmt.Fprintf(&b, ":%d", e.Col)
+	}
+	b.WriteString(": ")
+	if e.Expr != "" {
+		fmt.Fprintf(&b, "<%s>: ", e.Expr)
+	}
+	b.WriteString(e.Reason)
+	if e.Source != "" {
+		fmt.Fprintf(&b, " (in: %s)", e.Source)
+	}
+	return b.String()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// errPattern splits text/template errors: parse errors carry a line, exec
+// errors a line, column and the expression being evaluated.
+var errPattern = regexp.MustCompile(`(?s)^template: (.*?):(\d+):(?:(\d+):)? (?:executing ".*?" at <(.*?)>: )?(.*)$`)
+
+func newError(name, src string, err error) *Error {
+	e := &Error{Template: name, Reason: err.Error(), Err: err}
+	m := errPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return e
+	}
+	e.Line, _ = strconv.Atoi(m[2])
+	e.Col, _ = strconv.Atoi(m[3])
+	e.Expr, e.Reason = m[4], m[5]
+	// The error may be in a partial rather than in this template.
+	if m[1] == name {
+		e.Source = sourceLine(src, e.Line)
+	} else if p := findPartial(m[1]); p != nil {
+		e.Template = p.path
+		e.Source = sourceLine(p.src, e.Line)
+	} else {
+		e.Template = m[1] // A {{define}} of this template
+	}
+	return e
+}
+
+func sourceLine(src string, line int) string {
+	lines := strings.Split(src, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	s := strings.TrimSpace(lines[line-1])
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+package tmpl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// funcs is the function library. Argument order follows the common
+// pipeline style, so the piped value comes last. A missing key is an error,
+// so optional vars are read with get: {{get .vars "x" | default "y"}}, or
+// tested with {{if hasKey .vars "x"}}.
+func (r *renderer) funcs(dir string) template.FuncMap {
+	return template.FuncMap{
+		"default":    defaultValue,
+		"get":        get,
+		"hasKey":     hasKey,
+		"env":        os.Getenv,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"replace":    replace,
+		"join":       join,
+		"quote":      func(v interface{}) Raw { return Raw(Quote(v)) },
+		"raw":        func(v interface{}) Raw { return Raw(toString(v)) },
+		"fileExists": fileExists,
+		"lookPath":   lookPath,
+		"include":    r.include(dir),
+		"base64":     encodeBase64,
+		"sha256":     sum256,
+
+		// Added to every output of a command template by escapeShell
+		escapeUnquoted: func(v interface{}) Raw { return escapeFor(stateNone, v) },
+		escapeSingle:   func(v interface{}) Raw { return escapeFor(stateSingle, v) },
+		escapeDouble:   func(v interface{}) Raw { return escapeFor(stateDouble, v) },
+		escapeANSI:     escapeANSIQuote,
+		escapeComment:  func(v interface{}) Raw { return escapeFor(stateComment, v) },
+		escapeHeredoc:  escapeHeredocBody,
+	}
+}
+
+// get returns m[key], or nil when the key is missing.
+func get(m interface{}, key string) interface{} {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil
+	}
+	v := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
+}
+
+func hasKey(m interface{}, key string) bool {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return false
+	}
+	return rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key())).IsValid()
+}
+
+// defaultValue returns def when v is missing, empty or zero.
+func defaultValue(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if rv.Len() == 0 {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v
+}
+
+func replace(old, new string, s interface{}) string {
+	return strings.ReplaceAll(toString(s), old, new)
+}
+
+// join joins a list with sep; a single value is returned as is.
+func join(sep string, list interface{}) string {
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return toString(list)
+	}
+	parts := make([]string, rv.Len())
+	for i := range parts {
+		parts[i] = toString(rv.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+// Quote wraps a value in single quotes for POSIX shells.
+func Quote(v interface{}) string {
+	return "'" + strings.ReplaceAll(toString(v), "'", `'\''`) + "'"
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(os.ExpandEnv(path))
+	return err == nil
+}
+
+// lookPath returns the full path of a command, or "" when it is not on
+// PATH.
+func lookPath(name string) string {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+func encodeBase64(v interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(toString(v)))
+}
+
+func sum256(v interface{}) string {
+	sum := sha256.Sum256([]byte(toString(v)))
+	return hex.EncodeToString(sum[:])
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case Raw:
+		return string(v)
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
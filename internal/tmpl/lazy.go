@@ -0,0 +1,149 @@
+package tmpl
+
+import (
+	"fmt"
+	"sort"
+	"text/template"
+	"text/template/parse"
+)
+
+// Lazy is a variable fetched on first use, such as a secret. Templates
+// fetch the lazy vars they refer to before executing, so a value that
+// cannot be read fails the render instead of printing as empty.
+type Lazy interface {
+	Value() (string, error)
+}
+
+// fetchLazy fetches the lazy values of .vars that t refers to. Templates
+// that use .vars or . as a whole fetch all of them. Partials are read as
+// if called with the top-level data, their usual caller.
+func fetchLazy(t *template.Template, data interface{}) error {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	vars, ok := m["vars"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	all := false
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+		fieldRefs(tt.Tree.Root, true, func(ident []string) {
+			switch {
+			case len(ident) == 0 || ident[0] != "vars":
+				all = all || len(ident) == 0
+			case len(ident) == 1:
+				all = true
+			default:
+				names[ident[1]] = true
+			}
+		})
+	}
+	if all {
+		for k := range vars {
+			names[k] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		if l, ok := vars[k].(Lazy); ok {
+			if _, err := l.Value(); err != nil {
+				return fmt.Errorf("secret '%s': %w", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldRefs reports the fields read from the top-level data: .a.b and
+// $.a.b as [a b], and . or $ on their own as an empty list. Inside the
+// body of with and range, dot is something else and is not reported.
+func fieldRefs(n parse.Node, root bool, fn func([]string)) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			fieldRefs(c, root, fn)
+		}
+	case *parse.ActionNode:
+		fieldRefs(n.Pipe, root, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			fieldRefs(c, root, fn)
+		}
+	case *parse.CommandNode:
+		if name, ok := OptionalVar(n); ok {
+			if root {
+				fn([]string{"vars", name})
+			}
+			return
+		}
+		for _, a := range n.Args {
+			fieldRefs(a, root, fn)
+		}
+	case *parse.FieldNode:
+		if root {
+			fn(n.Ident)
+		}
+	case *parse.DotNode:
+		if root {
+			fn(nil)
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" {
+			fn(n.Ident[1:])
+		}
+	case *parse.ChainNode:
+		fieldRefs(n.Node, root, fn)
+	case *parse.IfNode:
+		fieldRefs(n.Pipe, root, fn)
+		fieldRefs(n.List, root, fn)
+		fieldRefs(n.ElseList, root, fn)
+	case *parse.RangeNode:
+		fieldRefs(n.Pipe, root, fn)
+		fieldRefs(n.List, false, fn)
+		fieldRefs(n.ElseList, root, fn)
+	case *parse.WithNode:
+		fieldRefs(n.Pipe, root, fn)
+		fieldRefs(n.List, false, fn)
+		fieldRefs(n.ElseList, root, fn)
+	case *parse.TemplateNode:
+		fieldRefs(n.Pipe, root, fn)
+	}
+}
+
+// OptionalVar reports the variable read by a get or hasKey command on
+// .vars with a constant key, such as get .vars "name".
+func OptionalVar(n *parse.CommandNode) (string, bool) {
+	if len(n.Args) != 3 {
+		return "", false
+	}
+	fn, ok := n.Args[0].(*parse.IdentifierNode)
+	if !ok || (fn.Ident != "get" && fn.Ident != "hasKey") {
+		return "", false
+	}
+	m, ok := n.Args[1].(*parse.FieldNode)
+	if !ok || len(m.Ident) != 1 || m.Ident[0] != "vars" {
+		return "", false
+	}
+	key, ok := n.Args[2].(*parse.StringNode)
+	if !ok {
+		return "", false
+	}
+	return key.Text, true
+}
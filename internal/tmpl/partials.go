@@ -0,0 +1,176 @@
+package tmpl
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// partial is a shared snippet from the templates directory.
+type partial struct {
+	name string
+	path string
+	src  string
+}
+
+// partials are defined in every template, sorted by name.
+var partials []partial
+
+// LoadPartials makes every file under dir a named template, callable from
+// any template as {{template "name" .}}. The name is the path relative to
+// dir without its extension, so proxy.tpl is "proxy" and shell/path.sh is
+// "shell/path". Files may {{define}} more templates. The set is parsed
+// once here so syntax errors and cycles are reported before anything runs.
+func LoadPartials(dir string) error {
+	var loaded []partial
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		name := filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel)))
+		loaded = append(loaded, partial{name: name, path: path, src: string(b)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].name < loaded[j].name })
+	for i := 1; i < len(loaded); i++ {
+		if loaded[i].name == loaded[i-1].name {
+			return fmt.Errorf("templates %s and %s both define '%s'", loaded[i-1].path, loaded[i].path, loaded[i].name)
+		}
+	}
+
+	r := &renderer{}
+	t := template.New("").Funcs(r.funcs(dir))
+	if err := parsePartials(t, loaded); err != nil {
+		return err
+	}
+	if err := checkCycles(t); err != nil {
+		return err
+	}
+	partials = loaded
+	return nil
+}
+
+// parsePartials adds the partials to the set of t. A partial named like
+// t itself is left out: the template being rendered wins.
+func parsePartials(t *template.Template, list []partial) error {
+	for _, p := range list {
+		if p.name == t.Name() {
+			continue
+		}
+		if _, err := t.New(p.name).Option("missingkey=error").Parse(p.src); err != nil {
+			e := newError(p.name, p.src, err)
+			e.Template = p.path
+			return e
+		}
+	}
+	return nil
+}
+
+// checkCycles reports templates that end up calling themselves through
+// {{template}}, which text/template would only stop at its depth limit.
+func checkCycles(t *template.Template) error {
+	calls := make(map[string][]string)
+	var names []string
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+		names = append(names, tt.Name())
+		templateCalls(tt.Tree.Root, func(name string) {
+			calls[tt.Name()] = append(calls[tt.Name()], name)
+		})
+	}
+	sort.Strings(names) // Stable errors when several cycles exist
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	mark := make(map[string]int)
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch mark[name] {
+		case done:
+			return nil
+		case visiting:
+			i := 0
+			for stack[i] != name {
+				i++
+			}
+			chain := append(append([]string{}, stack[i:]...), name)
+			return fmt.Errorf("template cycle: %s", strings.Join(chain, " -> "))
+		}
+		mark[name] = visiting
+		stack = append(stack, name)
+		for _, callee := range calls[name] {
+			if err := visit(callee); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		mark[name] = done
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateCalls reports the name of every {{template}} action under n.
+func templateCalls(n parse.Node, fn func(string)) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			templateCalls(c, fn)
+		}
+	case *parse.IfNode:
+		templateCalls(n.List, fn)
+		templateCalls(n.ElseList, fn)
+	case *parse.RangeNode:
+		templateCalls(n.List, fn)
+		templateCalls(n.ElseList, fn)
+	case *parse.WithNode:
+		templateCalls(n.List, fn)
+		templateCalls(n.ElseList, fn)
+	case *parse.TemplateNode:
+		fn(n.Name)
+	}
+}
+
+func findPartial(name string) *partial {
+	for i := range partials {
+		if partials[i].name == name {
+			return &partials[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package tmpl
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Raw is text already fit for a shell command, such as a list of quoted
+// package names; command templates insert it unchanged.
+type Raw string
+
+// Names of the escapers appended to the actions of command templates.
+const (
+	escapeUnquoted = "_shellArg"
+	escapeSingle   = "_shellSingle"
+	escapeDouble   = "_shellDouble"
+	escapeANSI     = "_shellANSI"
+	escapeComment  = "_shellComment"
+	escapeHeredoc  = "_shellHeredoc" // Takes the delimiter and whether it is quoted
+)
+
+// shellState is the quoting context at a point of a command.
+type shellState int
+
+const (
+	stateNone     shellState = iota
+	stateSingle              // '...'
+	stateDouble              // "..."
+	stateANSI                // $'...', C escapes in bash but not in dash
+	stateSubst               // $(...), a command of its own
+	stateBacktick            // `...`, whose escaping rules are not followed
+	stateComment             // # up to the end of the line
+	stateHeredoc             // The body of a here-document
+	stateUnknown             // Anything the scanner cannot follow, up to the end
+)
+
+// heredoc is a here-document started by <<delim or <<-delim.
+type heredoc struct {
+	delim  string
+	strip  bool // <<- strips leading tabs
+	quoted bool // A quoted delimiter leaves the body unexpanded
+}
+
+// safeArg matches words the shell takes literally, which are left unquoted
+// to keep commands readable.
+var safeArg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// ShellArg quotes a value as a single shell word when needed.
+func ShellArg(s string) string {
+	if safeArg.MatchString(s) {
+		return s
+	}
+	return Quote(s)
+}
+
+// ShellArgs quotes every word of a space-separated list individually.
+func ShellArgs(list string) Raw {
+	words := strings.Fields(list)
+	for i, w := range words {
+		words[i] = ShellArg(w)
+	}
+	return Raw(strings.Join(words, " "))
+}
+
+func escapeFor(st shellState, v interface{}) Raw {
+	if r, ok := v.(Raw); ok {
+		return r
+	}
+	s := toString(v)
+	switch st {
+	case stateSingle:
+		return Raw(strings.ReplaceAll(s, "'", `'\''`))
+	case stateDouble:
+		return Raw(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(s))
+	case stateComment:
+		return Raw(strings.NewReplacer("\n", " ", "\r", " ").Replace(s))
+	}
+	return Raw(ShellArg(s))
+}
+
+// escapeANSIQuote checks a value for $'...', which bash reads with C escapes
+// and dash as plain single quotes. No escaping works for both, so quotes
+// and backslashes are refused.
+func escapeANSIQuote(v interface{}) (Raw, error) {
+	if r, ok := v.(Raw); ok {
+		return r, nil
+	}
+	s := toString(v)
+	if strings.ContainsAny(s, `'\`) {
+		return "", fmt.Errorf("value with a quote or backslash inside $'...'")
+	}
+	return Raw(s), nil
+}
+
+// escapeHeredocBody escapes a value for the body of a here-document. A
+// value holding the delimiter on a line of its own would end the body
+// early, so it is refused.
+func escapeHeredocBody(delim string, quoted bool, v interface{}) (Raw, error) {
+	s := toString(v)
+	if r, ok := v.(Raw); ok {
+		s = string(r)
+	}
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimLeft(line, "\t") == delim {
+			return "", fmt.Errorf("value contains the here-document delimiter '%s'", delim)
+		}
+	}
+	if _, ok := v.(Raw); ok || quoted {
+		return Raw(s), nil
+	}
+	return Raw(strings.NewReplacer(`\`, `\\`, "$", `\$`, "`", "\\`").Replace(s)), nil
+}
+
+// escapeShell appends the escaper matching the quoting context to every
+// action that prints something. The context is tracked through the literal
+// text in document order; after if, range and with it is the one their
+// main branch ends in. A {{template}} call continues in the context of its
+// caller: each context gets its own escaped copy of the called template.
+func escapeShell(t *template.Template) error {
+	e := &shellEscaper{
+		set:    t,
+		orig:   make(map[string]*parse.Tree),
+		copies: make(map[string]escapedCopy),
+		count:  make(map[string]int),
+	}
+	for _, sub := range t.Templates() {
+		if sub.Tree != nil {
+			e.orig[sub.Name()] = sub.Tree.Copy()
+		}
+	}
+	if t.Tree != nil {
+		e.escapeList(t.Tree.Root, shellScanner{})
+	}
+	return e.err
+}
+
+// shellEscaper escapes a template set from its top-level template down.
+type shellEscaper struct {
+	set    *template.Template
+	orig   map[string]*parse.Tree // Unescaped templates, by name
+	copies map[string]escapedCopy // By called name and caller context
+	count  map[string]int         // Copies made of each template
+	err    error
+}
+
+// escapedCopy is a template escaped for the context of its callers.
+type escapedCopy struct {
+	name string
+	end  shellScanner // The context after it
+}
+
+func (e *shellEscaper) escapeList(l *parse.ListNode, sc shellScanner) shellScanner {
+	if l == nil {
+		return sc
+	}
+	for _, n := range l.Nodes {
+		switch n := n.(type) {
+		case *parse.TextNode:
+			sc.scan(n.Text)
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) == 0 {
+				n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+					NodeType: parse.NodeCommand,
+					Pos:      n.Pos,
+					Args:     sc.escaper(n.Pos),
+				})
+				sc.action()
+			}
+		case *parse.IfNode:
+			sc = e.escapeBranch(&n.BranchNode, sc)
+		case *parse.RangeNode:
+			sc = e.escapeBranch(&n.BranchNode, sc)
+		case *parse.WithNode:
+			sc = e.escapeBranch(&n.BranchNode, sc)
+		case *parse.TemplateNode:
+			n.Name, sc = e.escapeCall(n.Name, sc)
+		}
+	}
+	return sc
+}
+
+func (e *shellEscaper) escapeBranch(b *parse.BranchNode, sc shellScanner) shellScanner {
+	e.escapeList(b.ElseList, sc.clone())
+	return e.escapeList(b.List, sc)
+}
+
+// escapeCall returns the name of the copy of template name escaped for
+// the context sc, and the context after it. The first copy keeps the name
+// so errors read as usual; checkCycles has ruled out endless recursion.
+func (e *shellEscaper) escapeCall(name string, sc shellScanner) (string, shellScanner) {
+	key := name + "\x00" + sc.key()
+	if c, ok := e.copies[key]; ok {
+		return c.name, c.end.clone()
+	}
+	orig, ok := e.orig[name]
+	if !ok {
+		return name, sc // Undefined, which fails when executed
+	}
+	c := escapedCopy{name: name}
+	if n := e.count[name]; n > 0 {
+		c.name = fmt.Sprintf("%s#%d", name, n)
+	}
+	e.count[name]++
+	tree := orig.Copy()
+	c.end = e.escapeList(tree.Root, sc.clone())
+	if _, err := e.set.AddParseTree(c.name, tree); err != nil && e.err == nil {
+		e.err = err
+	}
+	e.copies[key] = c
+	return c.name, c.end.clone()
+}
+
+// shellScanner follows the quoting context through the literal text of a
+// command, enough to pick the escaper of each action. Contexts it cannot
+// follow end in stateUnknown, where values get full ShellArg quoting.
+type shellScanner struct {
+	stack   []shellState // Nested contexts, innermost last; empty is stateNone
+	inWord  bool         // The last byte was part of a word, so # is literal
+	pending []heredoc    // Here-documents whose body starts at the next newline
+	body    heredoc      // The here-document being read in stateHeredoc
+	line    []byte       // Its current line
+	dirty   bool         // An action printed into the current line
+}
+
+func (sc *shellScanner) state() shellState {
+	if len(sc.stack) == 0 {
+		return stateNone
+	}
+	return sc.stack[len(sc.stack)-1]
+}
+
+func (sc *shellScanner) push(st shellState) { sc.stack = append(sc.stack, st) }
+func (sc *shellScanner) pop()               { sc.stack = sc.stack[:len(sc.stack)-1] }
+
+func (sc shellScanner) clone() shellScanner {
+	sc.stack = append([]shellState(nil), sc.stack...)
+	sc.pending = append([]heredoc(nil), sc.pending...)
+	sc.line = append([]byte(nil), sc.line...)
+	return sc
+}
+
+// key identifies the context, to share the escaped copy of a template
+// between calls made in the same one.
+func (sc *shellScanner) key() string {
+	return fmt.Sprintf("%v %v %v %v %q %v", sc.stack, sc.inWord, sc.pending, sc.body, sc.line, sc.dirty)
+}
+
+// escaper returns the escaper call for an action in the current context.
+func (sc *shellScanner) escaper(pos parse.Pos) []parse.Node {
+	ident := func(name string) parse.Node { return parse.NewIdentifier(name).SetTree(nil).SetPos(pos) }
+	switch sc.state() {
+	case stateSingle:
+		return []parse.Node{ident(escapeSingle)}
+	case stateDouble:
+		return []parse.Node{ident(escapeDouble)}
+	case stateANSI:
+		return []parse.Node{ident(escapeANSI)}
+	case stateComment:
+		return []parse.Node{ident(escapeComment)}
+	case stateHeredoc:
+		return []parse.Node{
+			ident(escapeHeredoc),
+			&parse.StringNode{NodeType: parse.NodeString, Pos: pos, Quoted: strconv.Quote(sc.body.delim), Text: sc.body.delim},
+			&parse.BoolNode{NodeType: parse.NodeBool, Pos: pos, True: sc.body.quoted},
+		}
+	}
+	return []parse.Node{ident(escapeUnquoted)}
+}
+
+// action records that an action printed something at this point.
+func (sc *shellScanner) action() {
+	switch sc.state() {
+	case stateNone, stateSubst:
+		sc.inWord = true
+	case stateHeredoc:
+		sc.dirty = true
+	}
+}
+
+// scan follows quotes, backslashes, comments and here-documents through
+// literal command text.
+func (sc *shellScanner) scan(text []byte) {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch sc.state() {
+		case stateNone, stateSubst:
+			i = sc.scanCommand(text, i)
+		case stateSingle:
+			if c == '\'' {
+				sc.pop()
+			}
+		case stateDouble:
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				sc.pop()
+			case '`':
+				sc.push(stateBacktick)
+			case '$':
+				if i+1 < len(text) && text[i+1] == '(' {
+					sc.push(stateSubst)
+					sc.inWord = false
+					i++
+				}
+			}
+		case stateANSI:
+			switch c {
+			case '\\':
+				i++
+			case '\'':
+				sc.pop()
+			}
+		case stateBacktick:
+			switch c {
+			case '\\':
+				i++
+			case '`':
+				sc.pop()
+			}
+		case stateComment:
+			if c == '\n' {
+				sc.pop()
+				sc.newline()
+			}
+		case stateHeredoc:
+			sc.scanHeredoc(c)
+		case stateUnknown:
+			return
+		}
+	}
+}
+
+// scanCommand reads the byte at text[i] outside of quotes and returns the
+// index of the last byte it consumed.
+func (sc *shellScanner) scanCommand(text []byte, i int) int {
+	inWord := sc.inWord
+	sc.inWord = true
+	switch c := text[i]; c {
+	case '\\':
+		i++
+	case '\'':
+		sc.push(stateSingle)
+	case '"':
+		sc.push(stateDouble)
+	case '`':
+		sc.push(stateBacktick)
+	case '$':
+		if i+1 < len(text) {
+			switch text[i+1] {
+			case '(':
+				sc.push(stateSubst)
+				sc.inWord = false
+				i++
+			case '\'':
+				sc.push(stateANSI)
+				i++
+			}
+		}
+	case '#':
+		if !inWord {
+			sc.push(stateComment)
+		}
+	case '(':
+		sc.inWord = false
+		if sc.state() == stateSubst {
+			sc.push(stateSubst) // Matched by the next ')'
+		}
+	case ')':
+		sc.inWord = false
+		if sc.state() == stateSubst {
+			sc.pop()
+		}
+	case '<':
+		sc.inWord = false
+		if strings.HasPrefix(string(text[i:]), "<<<") {
+			return i + 2
+		}
+		if strings.HasPrefix(string(text[i:]), "<<") {
+			return sc.scanDelim(text, i+2)
+		}
+	case '\n':
+		sc.inWord = false
+		sc.newline()
+	case ' ', '\t', ';', '&', '|', '>':
+		sc.inWord = false
+	}
+	return i
+}
+
+// scanDelim reads the delimiter of a here-document from text[i:], past the
+// <<, and returns the index of its last byte. A delimiter that runs into
+// an action cannot be known, so the rest of the command is unknown.
+func (sc *shellScanner) scanDelim(text []byte, i int) int {
+	h := heredoc{}
+	if i < len(text) && text[i] == '-' {
+		h.strip = true
+		i++
+	}
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	var delim []byte
+	for ; i < len(text) && !strings.ContainsRune(" \t\n;&|<>()", rune(text[i])); i++ {
+		switch c := text[i]; c {
+		case '\'', '"':
+			end := bytes.IndexByte(text[i+1:], c)
+			if end < 0 {
+				i = len(text)
+				break
+			}
+			delim = append(delim, text[i+1:i+1+end]...)
+			i += end + 1
+			h.quoted = true
+		case '\\':
+			if i+1 < len(text) {
+				i++
+				delim = append(delim, text[i])
+			}
+			h.quoted = true
+		default:
+			delim = append(delim, c)
+		}
+	}
+	if i >= len(text) || len(delim) == 0 {
+		sc.push(stateUnknown)
+		return len(text)
+	}
+	h.delim = string(delim)
+	sc.pending = append(sc.pending, h)
+	return i - 1
+}
+
+// newline starts the body of the next pending here-document, if any.
+func (sc *shellScanner) newline() {
+	if len(sc.pending) == 0 {
+		return
+	}
+	sc.body = sc.pending[0]
+	sc.pending = sc.pending[1:]
+	sc.line = sc.line[:0]
+	sc.dirty = false
+	sc.push(stateHeredoc)
+}
+
+// scanHeredoc reads a byte of a here-document body, which ends at a line
+// holding only the delimiter.
+func (sc *shellScanner) scanHeredoc(c byte) {
+	if c != '\n' {
+		sc.line = append(sc.line, c)
+		return
+	}
+	line := string(sc.line)
+	if sc.body.strip {
+		line = strings.TrimLeft(line, "\t")
+	}
+	end := !sc.dirty && line == sc.body.delim
+	sc.line = sc.line[:0]
+	sc.dirty = false
+	if end {
+		sc.pop()
+		sc.inWord = false
+		sc.newline()
+	}
+}
@@ -0,0 +1,158 @@
+package tmpl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderCmdQuoting(t *testing.T) {
+	data := map[string]interface{}{
+		"x":    "a b; rm -rf /",
+		"q":    `it's "x" $HOME ` + "`id`" + `\`,
+		"safe": "abc",
+		"nl":   "a\nrm -rf /",
+		"eof":  "x\nEOF\nrm -rf /",
+		"raw":  Raw("a 'b'"),
+		"on":   true,
+		"off":  false,
+		"list": []string{"a b", "c'd"},
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"unquoted", "echo {{.x}}", `echo 'a b; rm -rf /'`},
+		{"unquoted safe", "echo {{.safe}}", `echo abc`},
+		{"single", "echo '{{.q}}'", `echo 'it'\''s "x" $HOME ` + "`id`" + `\'`},
+		{"double", `echo "{{.q}}"`, `echo "it's \"x\" \$HOME \` + "`id\\`" + `\\"`},
+		{"backslash keeps quote", `echo \'{{.x}}`, `echo \''a b; rm -rf /'`},
+		{"ansi", "echo $'{{.safe}}'", "echo $'abc'"},
+		{"subst", "echo $(echo {{.x}})", `echo $(echo 'a b; rm -rf /')`},
+		{"subst in double", `echo "$(echo {{.x}}) {{.x}}"`, `echo "$(echo 'a b; rm -rf /') a b; rm -rf /"`},
+		{"nested subst", `echo "$(f "$(g {{.x}})")"`, `echo "$(f "$(g 'a b; rm -rf /')")"`},
+		{"subst parens", `echo $(f (a) {{.x}}) "{{.x}}"`, `echo $(f (a) 'a b; rm -rf /') "a b; rm -rf /"`},
+		{"backtick", "echo `echo {{.x}}`", "echo `echo 'a b; rm -rf /'`"},
+		{"backtick in double", "echo \"`echo {{.x}}`\"", "echo \"`echo 'a b; rm -rf /'`\""},
+		{"comment", "# don't forget\necho {{.x}}", "# don't forget\necho 'a b; rm -rf /'"},
+		{"value in comment", "echo # {{.nl}}\necho {{.x}}", "echo # a rm -rf /\necho 'a b; rm -rf /'"},
+		{"hash in word", "echo a#'{{.x}}'", `echo a#'a b; rm -rf /'`},
+		{"hash after value", "echo {{.safe}}#'{{.x}}'", `echo abc#'a b; rm -rf /'`},
+		{"heredoc", "cat <<EOF\n{{.q}}\nEOF\necho {{.x}}", "cat <<EOF\nit's \"x\" \\$HOME \\`id\\`\\\\\nEOF\necho 'a b; rm -rf /'"},
+		{"heredoc dash", "cat <<-EOF\n\t{{.x}}\n\tEOF\necho {{.x}}", "cat <<-EOF\n\ta b; rm -rf /\n\tEOF\necho 'a b; rm -rf /'"},
+		{"heredoc quoted", "cat <<'EOF' >f\n{{.q}}\nEOF\necho '{{.x}}'", "cat <<'EOF' >f\n" + data["q"].(string) + "\nEOF\necho 'a b; rm -rf /'"},
+		{"heredoc two", "cat <<A <<\"B\"\n{{.q}}\nA\n{{.q}}\nB\necho {{.x}}", "cat <<A <<\"B\"\nit's \"x\" \\$HOME \\`id\\`\\\\\nA\n" + data["q"].(string) + "\nB\necho 'a b; rm -rf /'"},
+		{"heredoc delimiter not alone", "cat <<EOF\nEOF x {{.safe}}\nEOF\necho {{.x}}", "cat <<EOF\nEOF x abc\nEOF\necho 'a b; rm -rf /'"},
+		{"herestring", "cat <<<{{.x}}", `cat <<<'a b; rm -rf /'`},
+		{"heredoc unknown delimiter", "cat <<{{.x}}\n'{{.x}}'", `cat <<'a b; rm -rf /'` + "\n'" + `'a b; rm -rf /''`},
+		{"raw", "echo '{{.raw}}' {{.raw}} {{raw .x}}", `echo 'a 'b'' a 'b' a b; rm -rf /`},
+		{"quote func", `echo {{quote .safe}}`, `echo 'abc'`},
+		{"if branches", `echo {{if .on}}'{{.x}}'{{else}}"{{.x}}"{{end}} {{.x}}`, `echo 'a b; rm -rf /' 'a b; rm -rf /'`},
+		{"else branch", `echo {{if .off}}'{{.x}}'{{else}}"{{.x}}"{{end}} {{.x}}`, `echo "a b; rm -rf /" 'a b; rm -rf /'`},
+		{"branch opens quote", `{{if .on}}echo '{{else}}printf '{{end}}{{.x}}' {{.x}}`, `echo 'a b; rm -rf /' 'a b; rm -rf /'`},
+		{"range", `for i in {{range .list}}"{{.}}" {{end}}; do :; done`, `for i in "a b" "c'd" ; do :; done`},
+		{"range unquoted", `ls {{range .list}}{{.}} {{end}}`, `ls 'a b' 'c'\''d' `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderCmd(tt.name, tt.src, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%q\n got  %q\n want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCmdRefuses(t *testing.T) {
+	data := map[string]interface{}{
+		"eof":   "x\nEOF\nrm -rf /",
+		"tab":   "x\n\t\tEOF",
+		"quote": "it's",
+		"bs":    `a\nb`,
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"heredoc delimiter", "cat <<EOF\n{{.eof}}\nEOF", "here-document delimiter 'EOF'"},
+		{"quoted heredoc delimiter", "cat <<'EOF'\n{{.eof}}\nEOF", "here-document delimiter 'EOF'"},
+		{"dash heredoc delimiter", "cat <<-EOF\n{{.tab}}\nEOF", "here-document delimiter 'EOF'"},
+		{"quote in ansi", "echo $'{{.quote}}'", "inside $'...'"},
+		{"backslash in ansi", "echo $'{{.bs}}'", "inside $'...'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderCmd(tt.name, tt.src, data)
+			if err == nil {
+				t.Fatalf("%q rendered as %q, want an error", tt.src, got)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%q: error %q does not mention %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellArgs(t *testing.T) {
+	if got, want := ShellArgs("git  foo bar's"), Raw(`git foo 'bar'\''s'`); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenderCmdTemplateContext(t *testing.T) {
+	data := map[string]interface{}{"x": "a b; rm -rf /", "q": `say "hi"`}
+	const def = `{{define "x"}}{{.x}}{{end}}{{define "open"}}echo '{{end}}`
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"unquoted", def + `echo {{template "x" .}}`, `echo 'a b; rm -rf /'`},
+		{"single", def + `echo '{{template "x" .}}'`, `echo 'a b; rm -rf /'`},
+		{"double", def + `echo "{{template "x" .}}"`, `echo "a b; rm -rf /"`},
+		{"every context", def + `echo {{template "x" .}} '{{template "x" .}}' "{{template "x" .}}" {{template "x" .}}`,
+			`echo 'a b; rm -rf /' 'a b; rm -rf /' "a b; rm -rf /" 'a b; rm -rf /'`},
+		{"heredoc", def + "cat <<EOF\n{{template \"x\" .}}\nEOF", "cat <<EOF\na b; rm -rf /\nEOF"},
+		{"nested", `{{define "y"}}"{{template "z" .}}"{{end}}{{define "z"}}{{.q}}{{end}}echo {{template "y" .}} '{{template "z" .}}'`,
+			`echo "say \"hi\"" 'say "hi"'`},
+		{"context after call", def + `{{template "open" .}}{{.x}}' {{.x}}`, `echo 'a b; rm -rf /' 'a b; rm -rf /'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderCmd(tt.name, tt.src, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%q\n got  %q\n want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCmdPartialInQuotes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "proxy.tpl"), []byte("--proxy {{.vars.proxy}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadPartials(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { partials = nil }()
+
+	data := map[string]interface{}{"vars": map[string]interface{}{"proxy": "http://h:1 x"}}
+	got, err := RenderCmd("run", `sh -c "curl {{template "proxy" .}} url" && curl {{template "proxy" .}}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `sh -c "curl --proxy http://h:1 x url" && curl --proxy 'http://h:1 x'`
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
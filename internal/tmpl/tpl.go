@@ -0,0 +1,114 @@
+// Package tmpl renders every template dotbuilder handles — commands, paths,
+// dotfiles, scripts and vars — with one function library, so a template
+// behaves the same wherever it is used.
+package tmpl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// baseDir anchors relative include paths of templates that do not come
+// from a file, such as commands.
+var baseDir string
+
+// SetBaseDir sets the directory relative includes are resolved against,
+// normally the directory of the config file.
+func SetBaseDir(dir string) { baseDir = dir }
+
+// Render parses src and executes it with data. name identifies the
+// template in errors. References to missing map keys, such as a mistyped
+// {{.vars.name}}, are errors.
+func Render(name, src string, data interface{}) (string, error) {
+	r := &renderer{data: data}
+	return r.render(name, src, baseDir)
+}
+
+// RenderCmd renders a shell command. Every interpolated value is quoted
+// for the shell context it lands in, so spaces, quotes, ';' or '$()' in a
+// value stay literal; {{raw .x}} or a Raw value opts out.
+func RenderCmd(name, src string, data interface{}) (string, error) {
+	r := &renderer{data: data, shell: true}
+	return r.render(name, src, baseDir)
+}
+
+// RenderFile renders src, read from path; includes are resolved relative
+// to the file.
+func RenderFile(path, src string, data interface{}) (string, error) {
+	r := &renderer{data: data, stack: []string{path}}
+	return r.render(path, src, filepath.Dir(path))
+}
+
+// Parse parses src with the function library without executing it, to
+// inspect its parse tree.
+func Parse(name, src string) (*template.Template, error) {
+	r := &renderer{}
+	return template.New(name).Funcs(r.funcs(baseDir)).Parse(src)
+}
+
+// renderer carries the state of one top-level render through includes.
+type renderer struct {
+	data  interface{}
+	shell bool     // Quote interpolated values for sh
+	stack []string // Files being included, outermost first
+}
+
+func (r *renderer) render(name, src, dir string) (string, error) {
+	t := template.New(name).Funcs(r.funcs(dir)).Option("missingkey=error")
+	if err := parsePartials(t, partials); err != nil {
+		return "", err
+	}
+	if _, err := t.Parse(src); err != nil {
+		return "", newError(name, src, err)
+	}
+	if err := checkCycles(t); err != nil {
+		return "", &Error{Template: name, Reason: err.Error(), Err: err}
+	}
+	if r.shell {
+		if err := escapeShell(t); err != nil {
+			return "", &Error{Template: name, Reason: err.Error(), Err: err}
+		}
+	}
+	if err := fetchLazy(t, r.data); err != nil {
+		return "", &Error{Template: name, Reason: err.Error(), Err: err}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, r.data); err != nil {
+		return "", newError(name, src, err)
+	}
+	return buf.String(), nil
+}
+
+// include renders another template file, with the data of the including
+// template unless given. Relative paths start at the including file. The
+// result is Raw: its own values were already quoted in a command.
+func (r *renderer) include(dir string) func(string, ...interface{}) (Raw, error) {
+	return func(path string, data ...interface{}) (Raw, error) {
+		path = os.ExpandEnv(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		for i, p := range r.stack {
+			if p == path {
+				chain := append(append([]string{}, r.stack[i:]...), path)
+				return "", fmt.Errorf("include cycle: %s", strings.Join(chain, " -> "))
+			}
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		sub := *r
+		sub.stack = append(append([]string{}, r.stack...), path)
+		if len(data) > 0 {
+			sub.data = data[0]
+		}
+		out, err := sub.render(path, string(b), filepath.Dir(path))
+		return Raw(out), err
+	}
+}
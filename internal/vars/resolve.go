@@ -0,0 +1,279 @@
+package vars
+
+import (
+	"dotbuilder/internal/tmpl"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// Resolve renders every variable that references others through
+// {{.vars.name}}, dependencies first. Strings nested in lists and maps are
+// rendered too; other values keep their type. It fails on a reference to
+// an undefined variable and on cycles, reporting the chain (a -> b -> a).
+// Optional references ({{get .vars "name"}}) may be undefined. The input
+// map is left untouched.
+func Resolve(vars map[string]interface{}) (map[string]interface{}, error) {
+	return ResolveOver(nil, vars)
+}
+
+// ResolveOver resolves vars as Resolve does, on top of base, which is
+// already resolved: vars may refer to base, but base values are final and
+// never rendered again. vars wins where both define a name. A string that
+// reads a lazy value, such as a secret, becomes lazy itself and is only
+// rendered when a template uses it.
+func ResolveOver(base, vars map[string]interface{}) (map[string]interface{}, error) {
+	refs := make(map[string][]string, len(vars))
+	reads := make(map[string][]string, len(vars)) // refs, and names from base
+	for k, v := range vars {
+		r := make(map[string]bool)
+		isTemplate, err := valueRefs(v, r)
+		if err != nil {
+			return nil, fmt.Errorf("var '%s': %w", k, err)
+		}
+		if !isTemplate {
+			continue
+		}
+		deps := []string{}
+		for _, name := range sortedNames(r) {
+			if _, ok := vars[name]; ok {
+				deps = append(deps, name)
+				reads[k] = append(reads[k], name)
+			} else if _, ok := base[name]; ok {
+				reads[k] = append(reads[k], name)
+			} else if r[name] {
+				return nil, fmt.Errorf("var '%s': undefined variable '%s'", k, name)
+			}
+		}
+		refs[k] = deps
+	}
+
+	out := make(map[string]interface{}, len(base)+len(vars))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range vars {
+		out[k] = v
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	mark := make(map[string]int)
+	var stack []string
+	var visit func(k string) error
+	visit = func(k string) error {
+		switch mark[k] {
+		case done:
+			return nil
+		case visiting:
+			i := 0
+			for stack[i] != k {
+				i++
+			}
+			chain := append(append([]string{}, stack[i:]...), k)
+			return fmt.Errorf("variable cycle: %s", strings.Join(chain, " -> "))
+		}
+		mark[k] = visiting
+		stack = append(stack, k)
+		for _, dep := range refs[k] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		mark[k] = done
+
+		if _, ok := refs[k]; !ok {
+			return nil
+		}
+		if s, ok := vars[k].(string); ok && readsLazy(reads[k], out) {
+			out[k] = &derived{name: k, src: s, vars: out}
+			return nil
+		}
+		v, err := renderValue(k, vars[k], out)
+		if err != nil {
+			return fmt.Errorf("var '%s': %w", k, err)
+		}
+		out[k] = v
+		return nil
+	}
+
+	keys := make([]string, 0, len(refs))
+	for k := range refs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // Stable errors when several cycles exist
+	for _, k := range keys {
+		if err := visit(k); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// readsLazy reports whether one of names is a lazy value in vars.
+func readsLazy(names []string, vars map[string]interface{}) bool {
+	for _, name := range names {
+		if _, ok := vars[name].(tmpl.Lazy); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Render executes s with {{.vars}} bound to vars; a reference to an
+// undefined variable is an error. name identifies s in errors.
+func Render(name, s string, vars map[string]interface{}) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	return tmpl.Render(name, s, map[string]interface{}{"vars": vars})
+}
+
+// renderValue renders the strings in v, descending into lists and maps.
+func renderValue(name string, v interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return Render(name, v, vars)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := renderValue(fmt.Sprintf("%s[%d]", name, i), item, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			r, err := renderValue(name+"."+k, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// valueRefs adds the references of every template string in v to refs,
+// see references. It reports whether v holds any template at all.
+func valueRefs(v interface{}, refs map[string]bool) (bool, error) {
+	isTemplate := false
+	switch v := v.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return false, nil
+		}
+		if err := references(v, refs); err != nil {
+			return false, err
+		}
+		return true, nil
+	case []interface{}:
+		for _, item := range v {
+			t, err := valueRefs(item, refs)
+			if err != nil {
+				return false, err
+			}
+			isTemplate = isTemplate || t
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			t, err := valueRefs(item, refs)
+			if err != nil {
+				return false, err
+			}
+			isTemplate = isTemplate || t
+		}
+	}
+	return isTemplate, nil
+}
+
+// References returns the variables a template refers to as .vars.name or
+// get .vars "name", sorted and without duplicates.
+func References(s string) ([]string, error) {
+	seen := make(map[string]bool)
+	if err := references(s, seen); err != nil {
+		return nil, err
+	}
+	return sortedNames(seen), nil
+}
+
+// references adds the variables s refers to to seen: true for .vars.name,
+// which must be defined, false for get or hasKey .vars "name", which may not.
+func references(s string, seen map[string]bool) error {
+	parsed, err := tmpl.Parse("v", s)
+	if err != nil {
+		return err
+	}
+	for _, t := range parsed.Templates() {
+		walk(t.Tree.Root, seen)
+	}
+	return nil
+}
+
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func walk(n parse.Node, seen map[string]bool) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c, seen)
+		}
+	case *parse.ActionNode:
+		walk(n.Pipe, seen)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walk(c, seen)
+		}
+	case *parse.CommandNode:
+		if name, ok := tmpl.OptionalVar(n); ok {
+			if _, ok := seen[name]; !ok {
+				seen[name] = false
+			}
+			return
+		}
+		for _, a := range n.Args {
+			walk(a, seen)
+		}
+	case *parse.FieldNode:
+		if len(n.Ident) >= 2 && n.Ident[0] == "vars" {
+			seen[n.Ident[1]] = true
+		}
+	case *parse.ChainNode:
+		walk(n.Node, seen)
+	case *parse.IfNode:
+		walk(n.Pipe, seen)
+		walk(n.List, seen)
+		walk(n.ElseList, seen)
+	case *parse.RangeNode:
+		walk(n.Pipe, seen)
+		walk(n.List, seen)
+		walk(n.ElseList, seen)
+	case *parse.WithNode:
+		walk(n.Pipe, seen)
+		walk(n.List, seen)
+		walk(n.ElseList, seen)
+	case *parse.TemplateNode:
+		walk(n.Pipe, seen)
+	}
+}
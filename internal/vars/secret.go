@@ -0,0 +1,73 @@
+package vars
+
+import (
+	"dotbuilder/pkg/logger"
+	"dotbuilder/pkg/redact"
+	"sync"
+)
+
+// Secret is a variable whose value is fetched the first time a template
+// uses it. The value is registered with the redactor so it never shows
+// up in logs or command output.
+type Secret struct {
+	Name  string
+	fetch func() (string, error)
+
+	once  sync.Once
+	value string
+	err   error
+}
+
+func NewSecret(name string, fetch func() (string, error)) *Secret {
+	return &Secret{Name: name, fetch: fetch}
+}
+
+// Value fetches the value on first use; later calls return the same
+// value or error. Templates call it before executing (see tmpl.Lazy), so
+// a secret that cannot be read fails the node using it.
+func (s *Secret) Value() (string, error) {
+	s.once.Do(func() {
+		s.value, s.err = s.fetch()
+		redact.Add(s.value)
+	})
+	return s.value, s.err
+}
+
+// String is what text/template prints. The value has normally been
+// fetched by then; a secret reached in a way the template scan does not
+// see and that fails to read prints as empty.
+func (s *Secret) String() string {
+	v, err := s.Value()
+	if err != nil {
+		logger.Fail("Secret '%s': %v", s.Name, err)
+	}
+	return v
+}
+
+// derived is a variable whose template reads a secret, rendered the first
+// time a template uses it so that commands which never print it never
+// fetch the secret. See ResolveOver.
+type derived struct {
+	name string
+	src  string
+	vars map[string]interface{}
+
+	once  sync.Once
+	value string
+	err   error
+}
+
+func (d *derived) Value() (string, error) {
+	d.once.Do(func() {
+		d.value, d.err = Render(d.name, d.src, d.vars)
+	})
+	return d.value, d.err
+}
+
+func (d *derived) String() string {
+	v, err := d.Value()
+	if err != nil {
+		logger.Fail("Variable '%s': %v", d.name, err)
+	}
+	return v
+}
@@ -0,0 +1,98 @@
+// Package vars keeps template variables together with where each value came
+// from, so precedence is explicit and explainable.
+package vars
+
+import "sort"
+
+// Layers in increasing precedence.
+const (
+	LayerFacts   = "facts"    // Detected system facts and defaults
+	LayerConfig  = "config"   // The main config file
+	LayerInclude = "include"  // Included config files
+	LayerOverlay = "overlay"  // Selected profiles and hosts
+	LayerEnvFile = "env-file" // my.env / .env
+	LayerEnv     = "env"      // DOTBUILDER_VAR_* environment variables
+	LayerCLI     = "cli"      // --var k=v
+)
+
+// Layers lists every layer from lowest to highest precedence.
+var Layers = []string{LayerFacts, LayerConfig, LayerInclude, LayerOverlay, LayerEnvFile, LayerEnv, LayerCLI}
+
+func rank(layer string) int {
+	for i, l := range Layers {
+		if l == layer {
+			return i
+		}
+	}
+	return -1
+}
+
+// Origin is one assignment of a variable.
+type Origin struct {
+	Layer  string
+	Source string // File, overlay or flag that set the value
+	Value  interface{}
+}
+
+// Store records every assignment; the value from the highest layer wins and
+// within a layer the last assignment wins.
+type Store struct {
+	history map[string][]Origin
+}
+
+func NewStore() *Store {
+	return &Store{history: make(map[string][]Origin)}
+}
+
+func (s *Store) Set(layer, source, key string, value interface{}) {
+	s.history[key] = append(s.history[key], Origin{Layer: layer, Source: source, Value: value})
+}
+
+// SetAll records every entry of m.
+func (s *Store) SetAll(layer, source string, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.Set(layer, source, k, m[k])
+	}
+}
+
+// Winner returns the assignment in effect for key.
+func (s *Store) Winner(key string) (Origin, bool) {
+	h := s.History(key)
+	if len(h) == 0 {
+		return Origin{}, false
+	}
+	return h[len(h)-1], true
+}
+
+// History returns the assignments of key ordered by precedence, the one in
+// effect last.
+func (s *Store) History(key string) []Origin {
+	h := append([]Origin{}, s.history[key]...)
+	sort.SliceStable(h, func(i, j int) bool { return rank(h[i].Layer) < rank(h[j].Layer) })
+	return h
+}
+
+// Keys returns every variable name, sorted.
+func (s *Store) Keys() []string {
+	keys := make([]string, 0, len(s.history))
+	for k := range s.history {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Values returns the value in effect for every variable.
+func (s *Store) Values() map[string]interface{} {
+	out := make(map[string]interface{}, len(s.history))
+	for k := range s.history {
+		o, _ := s.Winner(k)
+		out[k] = o.Value
+	}
+	return out
+}
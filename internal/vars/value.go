@@ -0,0 +1,45 @@
+package vars
+
+import (
+	"dotbuilder/pkg/redact"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// String coerces a variable to the text used outside templates, such as
+// shell environments, `when:` conditions and listings: lists are joined
+// with spaces and maps are written as JSON. Secrets, and variables made
+// from them, are masked rather than fetched.
+func String(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case *Secret, *derived:
+		return redact.Mask
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = String(item)
+		}
+		return strings.Join(parts, " ")
+	case map[string]interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// Strings coerces every variable with String.
+func Strings(m map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = String(v)
+	}
+	return out
+}
@@ -59,6 +59,28 @@ var BaseBatchTemplates = map[string]string{
 	"cargo":   "cargo install {{.names}}",
 }
 
+var BaseBatchUpgradeTemplates = map[string]string{
+	"apt-get": "apt-get install --only-upgrade -y {{.names}}",
+	"pacman":  "pacman -S --noconfirm {{.names}}",
+	"apk":     "apk add --upgrade {{.names}}",
+	"dnf":     "dnf upgrade -y {{.names}}",
+	"yum":     "yum update -y {{.names}}",
+	"zypper":  "zypper update -y {{.names}}",
+	"brew":    "brew upgrade {{.names}}",
+	"pip":     "pip install -U {{.names}}",
+	"npm":     "npm update -g {{.names}}",
+}
+
+var BaseSingleUpgradeTemplates = map[string]string{
+	"apt-get": "apt-get install --only-upgrade -y {{.name}}",
+	"apt":     "apt install --only-upgrade -y {{.name}}",
+	"pacman":  "pacman -S --noconfirm {{.name}}",
+	"apk":     "apk add --upgrade {{.name}}",
+	"dnf":     "dnf upgrade -y {{.name}}",
+	"yum":     "yum update -y {{.name}}",
+	"zypper":  "zypper update -y {{.name}}",
+}
+
 var BaseSingleTemplates = map[string]string{
 	"apt-get": "apt-get install -y {{.name}}",
 	"pacman":  "pacman -S --noconfirm {{.name}}",
@@ -77,6 +99,27 @@ var BaseCheckTemplates = map[string]string{
     "brew":    "brew list {{.name}}",
 }
 
+var BaseRemoveTemplates = map[string]string{
+	"apt-get": "apt-get remove -y {{.name}}",
+	"apt":     "apt remove -y {{.name}}",
+	"pacman":  "pacman -R --noconfirm {{.name}}",
+	"yay":     "yay -R --noconfirm {{.name}}",
+	"paru":    "paru -R --noconfirm {{.name}}",
+	"apk":     "apk del {{.name}}",
+	"dnf":     "dnf remove -y {{.name}}",
+	"yum":     "yum remove -y {{.name}}",
+	"zypper":  "zypper remove -y {{.name}}",
+	"brew":    "brew uninstall {{.name}}",
+	"pip":     "pip uninstall -y {{.name}}",
+	"npm":     "npm uninstall -g {{.name}}",
+	"cargo":   "cargo uninstall {{.name}}",
+	"conda":   "conda remove -y {{.name}}",
+	"gem":     "gem uninstall -x {{.name}}",
+	"go":      "rm -f $(go env GOPATH)/bin/$(basename {{.name}})",
+	"snap":    "snap remove {{.name}}",
+	"flatpak": "flatpak uninstall -y {{.name}}",
+}
+
 var DefaultPMTemplatesMap = map[string]PMTemplates{
 	"brew":  {Check: "brew list {{.name}}", Install: "brew install {{.name}}", Update: "brew upgrade {{.name}}"},
 	"npm":   {Check: "npm ls -g {{.name}}", Install: "npm install -g {{.name}}", Update: "npm update -g {{.name}}"},
@@ -91,7 +134,7 @@ var DefaultPMTemplatesMap = map[string]PMTemplates{
 	},
 	"go": {
 		Check:   "ls $(go env GOPATH)/bin/{{.name}}",
-		Install: "go install {{.name}}@latest",
+		Install: "go install {{.name}}{{if not .version}}@latest{{end}}",
 		Update:  "go install {{.name}}@latest",
 	},
 	"snap": {
@@ -130,3 +173,72 @@ func GetPMTemplates(pm string) (string, string, string) {
     return "", "", ""
 }
 
+
+// PinnedNameTemplates render "name at exact version" for an install command.
+var PinnedNameTemplates = map[string]string{
+	"apt-get": "{{.name}}={{.version}}",
+	"apt":     "{{.name}}={{.version}}",
+	"apk":     "{{.name}}={{.version}}",
+	"zypper":  "{{.name}}={{.version}}",
+	"dnf":     "{{.name}}-{{.version}}",
+	"yum":     "{{.name}}-{{.version}}",
+	"pip":     "{{.name}}=={{.version}}",
+	"npm":     "{{.name}}@{{.version}}",
+	"go":      "{{.name}}@{{.version}}",
+	"cargo":   "{{.name}} --version {{.version}} --force",
+	"gem":     "{{.name}} -v {{.version}}",
+	"conda":   "{{.name}}={{.version}}",
+}
+
+// ConstraintNameTemplates render "name within constraint" for managers that
+// understand version ranges. {{.version}} is the raw constraint.
+var ConstraintNameTemplates = map[string]string{
+	"pip":   "'{{.name}}{{.version}}'",
+	"npm":   "'{{.name}}@{{.version}}'",
+	"cargo": "{{.name}} --version '{{.version}}' --force",
+	"gem":   "{{.name}} -v '{{.version}}'",
+	"conda": "'{{.name}}{{.version}}'",
+}
+
+// VersionQueryTemplates print the installed version of {{.name}}, or nothing.
+var VersionQueryTemplates = map[string]string{
+	"apt-get": "dpkg-query -W -f='${Version}' {{.name}}",
+	"apt":     "dpkg-query -W -f='${Version}' {{.name}}",
+	"pacman":  "pacman -Q {{.name}} | awk '{print $2}'",
+	"yay":     "pacman -Q {{.name}} | awk '{print $2}'",
+	"paru":    "pacman -Q {{.name}} | awk '{print $2}'",
+	"dnf":     "rpm -q --qf '%{VERSION}' {{.name}}",
+	"yum":     "rpm -q --qf '%{VERSION}' {{.name}}",
+	"zypper":  "rpm -q --qf '%{VERSION}' {{.name}}",
+	"apk":     "apk info -e -v {{.name}} | sed 's/^{{.name}}-//; s/-r[0-9]*$//'",
+	"brew":    "brew list --versions {{.name}} | awk '{print $2}'",
+	"pip":     "pip show {{.name}} | sed -n 's/^Version: //p'",
+	"npm":     "npm ls -g --depth=0 --parseable --long {{.name}} | sed -n 's/.*@//p'",
+	"cargo":   "cargo install --list | awk '$1 == \"{{.name}}\" {sub(/^v/, \"\", $2); sub(/:$/, \"\", $2); print $2}'",
+	"gem":     "gem list -e {{.name}} | sed -n 's/.*(\\([^,)]*\\).*/\\1/p'",
+	"conda":   "conda list -f {{.name}} | awk '!/^#/ {print $2}'",
+}
+
+// IsKnownPM reports whether dotbuilder has templates for a package manager.
+// "none" installs through the package's own commands only.
+func IsKnownPM(pm string) bool {
+	if pm == "none" {
+		return true
+	}
+	for _, m := range []map[string]string{BaseSingleTemplates, BaseBatchTemplates, BaseCheckTemplates, BaseRemoveTemplates, SystemUpdateCmds} {
+		if _, ok := m[pm]; ok {
+			return true
+		}
+	}
+	if _, ok := DefaultPMTemplatesMap[pm]; ok {
+		return true
+	}
+	for _, aliases := range PMAliases {
+		for _, a := range aliases {
+			if a == pm {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,7 +1,9 @@
 package logger
 
 import (
+	"dotbuilder/pkg/redact"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -11,6 +13,7 @@ import (
 var (
 	debugEnabled bool
 	logMu        sync.Mutex
+	out          io.Writer = os.Stdout
 )
 
 // ANSI Color Codes
@@ -36,13 +39,21 @@ func ts() string {
 }
 
 func printLog(prefix, msg string) {
+	msg = redact.String(msg)
 	logMu.Lock()
 	defer logMu.Unlock()
-	fmt.Printf("%s %s %s\n", ts(), prefix, msg)
+	fmt.Fprintf(out, "%s %s %s\n", ts(), prefix, msg)
 }
 
 func SetDebug(enable bool) { debugEnabled = enable }
 
+// SetOutput redirects log lines, e.g. to stderr when stdout carries data.
+func SetOutput(w io.Writer) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	out = w
+}
+
 func Info(format string, args ...interface{}) {
 	printLog(Blue+"[INFO]"+Reset, fmt.Sprintf(format, args...))
 }
@@ -56,6 +67,11 @@ func Error(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// Fail logs an error without terminating the process.
+func Fail(format string, args ...interface{}) {
+	printLog(Red+"[ERRO]"+Reset, fmt.Sprintf(format, args...))
+}
+
 func Success(format string, args ...interface{}) {
 	printLog(Green+"[DONE]"+Reset, fmt.Sprintf(format, args...))
 }
@@ -0,0 +1,92 @@
+// Package redact scrubs known secret values from text before it is shown:
+// log lines, command output, [PLAN] lines, node errors and the state file.
+package redact
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every redacted value.
+const Mask = "***"
+
+var (
+	mu       sync.RWMutex
+	values   []string // Longest first, so overlapping values are fully hidden
+	replacer *strings.Replacer
+)
+
+// minLen keeps very short values such as "1" or "yes" from garbling
+// unrelated output.
+const minLen = 4
+
+// sensitive are name fragments marking a variable as sensitive.
+var sensitive = []string{"secret", "key", "token", "password", "pwd", "auth"}
+
+// IsSensitive reports whether a variable name looks like it holds a secret.
+func IsSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitive {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add registers values to hide. Values shorter than four characters are
+// ignored.
+func Add(vals ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range vals {
+		if len(v) < minLen || contains(values, v) {
+			continue
+		}
+		values = append(values, v)
+	}
+	sort.SliceStable(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, Mask)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// String returns s with every registered value replaced by Mask.
+func String(s string) string {
+	mu.RLock()
+	r := replacer
+	mu.RUnlock()
+	if r == nil {
+		return s
+	}
+	return r.Replace(s)
+}
+
+// Error wraps err so its message is redacted; errors.As and errors.Is
+// still see the original.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err}
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string { return String(e.err.Error()) }
+func (e *redactedError) Unwrap() error { return e.err }
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package shell
 import (
 	"bufio"
 	"dotbuilder/pkg/logger"
+	"dotbuilder/pkg/redact"
 	"fmt"
 	"io"
 	"os"
@@ -27,9 +28,10 @@ func NewRunner(dryRun bool) *Runner {
 	}
 }
 
-// formatCmdForLog shortens multi-line commands for display
+// formatCmdForLog shortens multi-line commands for display and hides
+// secret values
 func formatCmdForLog(cmdStr string) string {
-	lines := strings.Split(strings.TrimSpace(cmdStr), "\n")
+	lines := strings.Split(strings.TrimSpace(redact.String(cmdStr)), "\n")
 	if len(lines) > 1 {
 		return fmt.Sprintf("%s ... (%d lines)", strings.TrimSpace(lines[0]), len(lines))
 	}
@@ -71,7 +73,7 @@ func (r *Runner) ExecStream(cmdStr string, id string) error {
 	streamOutput := func(pipe io.Reader, isErr bool) {
 		scanner := bufio.NewScanner(pipe)
 		for scanner.Scan() {
-			text := scanner.Text()
+			text := redact.String(scanner.Text())
 			outputMu.Lock()
 			prefixColor := "\033[34m" // Blue
 			if isErr {
@@ -119,6 +121,24 @@ func (r *Runner) ExecSilent(cmdStr string) int {
 	return 0
 }
 
+// ExecOutput runs a read-only query and returns its trimmed stdout. Like
+// ExecSilent it does not run in dry-run mode.
+func (r *Runner) ExecOutput(cmdStr string) (string, error) {
+	if r.DryRun {
+		return "", fmt.Errorf("dry-run")
+	}
+
+	logger.Debug("ExecOutput: %s", formatCmdForLog(cmdStr))
+	cmd := exec.Command("sh", "-c", cmdStr)
+	cmd.Env = os.Environ()
+	for k, v := range r.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
 func CheckCommandExists(cmd string) bool {
 	_, err := exec.LookPath(cmd)
 	return err == nil